@@ -0,0 +1,317 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/rothgar/k/pkg/kspace"
+)
+
+// flagsWithValue are kubectl flags that take a value. Flags that aren't in
+// this list are treated as booleans, so their next argument isn't consumed.
+// Flags with an optional value like --dry-run and --cascade only take it
+// after "=" and aren't listed.
+var flagsWithValue = map[string]bool{
+	// global flags
+	"as":                    true,
+	"as-group":              true,
+	"as-uid":                true,
+	"cache-dir":             true,
+	"certificate-authority": true,
+	"client-certificate":    true,
+	"client-key":            true,
+	"cluster":               true,
+	"context":               true,
+	"kubeconfig":            true,
+	"log-dir":               true,
+	"log-file":              true,
+	"namespace":             true,
+	"profile":               true,
+	"profile-output":        true,
+	"request-timeout":       true,
+	"server":                true,
+	"tls-server-name":       true,
+	"token":                 true,
+	"user":                  true,
+	"v":                     true,
+	"vmodule":               true,
+	// common command flags
+	"address":             true,
+	"chunk-size":          true,
+	"container":           true,
+	"field-manager":       true,
+	"field-selector":      true,
+	"filename":            true,
+	"for":                 true,
+	"grace-period":        true,
+	"image":               true,
+	"kustomize":           true,
+	"label-columns":       true,
+	"limit-bytes":         true,
+	"max-log-requests":    true,
+	"output":              true,
+	"patch":               true,
+	"pod-running-timeout": true,
+	"pod-selector":        true,
+	"replicas":            true,
+	"selector":            true,
+	"since":               true,
+	"since-time":          true,
+	"sort-by":             true,
+	"subresource":         true,
+	"tail":                true,
+	"template":            true,
+	"timeout":             true,
+	"type":                true,
+	// create, run and expose flags
+	"annotation":       true,
+	"annotations":      true,
+	"class":            true,
+	"cluster-ip":       true,
+	"clusterrole":      true,
+	"copy-to":          true,
+	"cpu-percent":      true,
+	"current-replicas": true,
+	"default-backend":  true,
+	"description":      true,
+	"docker-email":     true,
+	"docker-password":  true,
+	"docker-server":    true,
+	"docker-username":  true,
+	"duration":         true,
+	"env":              true,
+	"external-ip":      true,
+	"from":             true,
+	"from-env-file":    true,
+	"from-file":        true,
+	"from-literal":     true,
+	"hard":             true,
+	"labels":           true,
+	"max":              true,
+	"max-unavailable":  true,
+	"min":              true,
+	"min-available":    true,
+	"name":             true,
+	"overrides":        true,
+	"port":             true,
+	"protocol":         true,
+	"resource":         true,
+	"resource-name":    true,
+	"restart":          true,
+	"role":             true,
+	"rule":             true,
+	"schedule":         true,
+	"serviceaccount":   true,
+	"target":           true,
+	"target-port":      true,
+	"to-revision":      true,
+	"value":            true,
+	"verb":             true,
+}
+
+// shortFlags maps kubectl shorthand flags to their long names
+var shortFlags = map[byte]string{
+	'A': "all-namespaces",
+	'L': "label-columns",
+	'R': "recursive",
+	'c': "container",
+	'f': "filename",
+	'h': "help",
+	'i': "stdin",
+	'k': "kustomize",
+	'l': "selector",
+	'n': "namespace",
+	'o': "output",
+	'p': "patch",
+	'q': "quiet",
+	's': "server",
+	't': "tty",
+	'v': "v",
+	'w': "watch",
+}
+
+// shortFlagsByVerb overrides shorthand flags that mean something different
+// for some commands
+var shortFlagsByVerb = map[string]map[byte]string{
+	"logs": {
+		'f': "follow",
+		'p': "previous",
+	},
+}
+
+// kubectlArgs is a kubectl command line split into its verb, flags and
+// positional arguments. Flags are stored by their long name no matter how
+// they were spelled (-n foo, -nfoo, --namespace foo, --namespace=foo).
+type kubectlArgs struct {
+	args []string
+	// verb is the first positional argument that isn't a kspace, e.g. get
+	verb string
+	// flags maps long flag names to their values, booleans are "true"
+	flags map[string][]string
+	// positional holds the index in args of every non-flag argument
+	positional []int
+	// dash is the index of "--" in args or -1
+	dash int
+}
+
+// parseKubectlArgs parses a kubectl command line. Arguments after "--"
+// belong to another command and are not parsed.
+func parseKubectlArgs(args []string) kubectlArgs {
+	a := kubectlArgs{
+		args:  args,
+		flags: make(map[string][]string),
+		dash:  -1,
+	}
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			a.dash = i
+			return a
+
+		case strings.HasPrefix(arg, "--"):
+			name, value, hasValue := strings.Cut(arg[2:], "=")
+			if !hasValue {
+				value = "true"
+				if flagsWithValue[name] && i+1 < len(args) {
+					i++
+					value = args[i]
+				}
+			}
+			a.flags[name] = append(a.flags[name], value)
+
+		case strings.HasPrefix(arg, "-") && len(arg) > 1:
+			// shorthand flags can be grouped like -it, and a flag with a
+			// value takes the rest of the group or the next argument
+			for j := 1; j < len(arg); j++ {
+				name := a.shortName(arg[j])
+				if !flagsWithValue[name] {
+					a.flags[name] = append(a.flags[name], "true")
+					continue
+				}
+				value := strings.TrimPrefix(arg[j+1:], "=")
+				if value == "" && i+1 < len(args) {
+					i++
+					value = args[i]
+				}
+				a.flags[name] = append(a.flags[name], value)
+				break
+			}
+
+		default:
+			if a.verb == "" && !kspace.IsKspace(arg) {
+				a.verb = arg
+			}
+			a.positional = append(a.positional, i)
+		}
+	}
+	return a
+}
+
+// shortName returns the long name of a shorthand flag
+func (a kubectlArgs) shortName(c byte) string {
+	if name, ok := shortFlagsByVerb[a.verb][c]; ok {
+		return name
+	}
+	if name, ok := shortFlags[c]; ok {
+		return name
+	}
+	return string(c)
+}
+
+// has checks if a flag was given in any spelling
+func (a kubectlArgs) has(name string) bool {
+	_, ok := a.flags[name]
+	return ok
+}
+
+// enabled checks if a boolean flag was given and not set to false
+func (a kubectlArgs) enabled(name string) bool {
+	values, ok := a.flags[name]
+	return ok && values[len(values)-1] != "false"
+}
+
+// value returns the last value given for a flag
+func (a kubectlArgs) value(name string) (string, bool) {
+	values, ok := a.flags[name]
+	if !ok {
+		return "", false
+	}
+	return values[len(values)-1], true
+}
+
+// splitKspaces separates kspaces from the arguments passed to kubectl. Only
+// positional arguments before "--" can be kspaces, so flag values and the
+// command run by exec or run (k exec pod -- grep :8080 file) are kept.
+func splitKspaces(args []string) ([]string, []string) {
+	parsed := parseKubectlArgs(args)
+
+	isKspace := make(map[int]bool)
+	for _, i := range parsed.positional {
+		if kspace.IsKspace(args[i]) {
+			isKspace[i] = true
+		}
+	}
+
+	var kspaces, rest []string
+	for i, arg := range args {
+		if isKspace[i] {
+			kspaces = append(kspaces, arg)
+		} else {
+			rest = append(rest, arg)
+		}
+	}
+	return kspaces, rest
+}
+
+// envDefaults holds the context and namespace from KUBE_CONTEXT and
+// KUBE_NAMESPACE
+type envDefaults struct {
+	context   string
+	namespace string
+}
+
+// targetContext returns the context kubectl will use for a target. An empty
+// string means the current context from kubeconfig.
+func targetContext(args []string, target Target, env envDefaults) string {
+	if context, ok := parseKubectlArgs(args).value("context"); ok {
+		return context
+	}
+	if target.context != "" {
+		return target.context
+	}
+	return env.context
+}
+
+// buildKubectlArgs adds the context and namespace for a target to args.
+// A flag the user passed always wins, then the kspace, then the
+// environment. The flags themselves come from kspace.Target so k and the
+// library agree on them.
+func buildKubectlArgs(args []string, target Target, env envDefaults) []string {
+	parsed := parseKubectlArgs(args)
+
+	var flags kspace.Target
+	if !parsed.has("context") {
+		flags.Context = target.context
+		if flags.Context == "" {
+			flags.Context = env.context
+		}
+	}
+	if !parsed.has("namespace") && !parsed.enabled("all-namespaces") {
+		flags.Namespace = target.namespace
+		if flags.Namespace == "" {
+			flags.Namespace = env.namespace
+		}
+	}
+	extra := flags.Flags()
+
+	cmdArgs := make([]string, 0, len(args)+len(extra))
+	if parsed.dash < 0 {
+		cmdArgs = append(cmdArgs, args...)
+		return append(cmdArgs, extra...)
+	}
+	// flags have to go before "--" or they're passed to the remote command
+	cmdArgs = append(cmdArgs, args[:parsed.dash]...)
+	cmdArgs = append(cmdArgs, extra...)
+	return append(cmdArgs, args[parsed.dash:]...)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// targetResult is the captured output of kubectl for a single target
+type targetResult struct {
+	Kspace    string `json:"kspace"`
+	Context   string `json:"context,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Stdout    string `json:"stdout"`
+	Stderr    string `json:"stderr"`
+	ExitCode  int    `json:"exitCode"`
+	Group     int    `json:"group"`
+}
+
+// collectKubectl runs kubectl (or a kubectl plugin) for kspace and captures
+// its output instead of printing it. --k-timeout and --k-retries apply like
+// they do to printed output.
+func collectKubectl(args []string, kspace string, r Runner) targetResult {
+	result := targetResult{Kspace: kspace}
+	retryKubectl(args, kspace, func() int {
+		var stdout, stderr bytes.Buffer
+		kCmd := r.Command(args)
+		kCmd.Stdout = &stdout
+		kCmd.Stderr = &stderr
+
+		result.ExitCode = 0
+		if err := startChild(kCmd); err != nil {
+			result.ExitCode = 1
+			stderr.WriteString(err.Error() + "\n")
+		} else {
+			timer := killAfter(kCmd, kOpts.timeout)
+			err := waitChild(kCmd)
+			if timer.stop() {
+				result.ExitCode = timeoutExitCode
+				fmt.Fprintf(&stderr, "timed out after %s\n", kOpts.timeout)
+			} else if exitError, ok := err.(*exec.ExitError); ok {
+				result.ExitCode = exitError.ExitCode()
+			}
+		}
+		result.Stdout = stdout.String()
+		result.Stderr = stderr.String()
+		return result.ExitCode
+	})
+	return result
+}
+
+// groupResults sorts results by kspace and numbers each distinct combination
+// of output and exit code starting at 1. The most common group comes first.
+func groupResults(results []targetResult) [][]targetResult {
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Kspace < results[j].Kspace
+	})
+
+	var groups [][]targetResult
+	index := make(map[string]int)
+	for _, r := range results {
+		key := fmt.Sprintf("%d\x00%s\x00%s", r.ExitCode, r.Stdout, r.Stderr)
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], r)
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool {
+		return len(groups[i]) > len(groups[j])
+	})
+	for i, group := range groups {
+		for j := range group {
+			group[j].Group = i + 1
+		}
+	}
+	return groups
+}
+
+// summarizeGroups describes how many targets returned the same output
+func summarizeGroups(groups [][]targetResult) string {
+	total := 0
+	for _, group := range groups {
+		total += len(group)
+	}
+	if len(groups) == 0 {
+		return "no targets"
+	}
+
+	var differs []string
+	for _, group := range groups[1:] {
+		for _, r := range group {
+			differs = append(differs, r.Kspace)
+		}
+	}
+	sort.Strings(differs)
+
+	summary := fmt.Sprintf("same on %d/%d targets", len(groups[0]), total)
+	if len(differs) > 0 {
+		summary += ", differs on " + strings.Join(differs, " ")
+	}
+	return summary
+}
+
+// renderResults prints collected results as a table followed by every
+// distinct output, or as JSON
+func renderResults(w io.Writer, results []targetResult, format string) error {
+	groups := groupResults(results)
+	summary := summarizeGroups(groups)
+
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			Results   []targetResult `json:"results"`
+			Identical bool           `json:"identical"`
+			Summary   string         `json:"summary"`
+		}{sortedResults(groups), len(groups) == 1, summary})
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "KSPACE\tEXIT\tOUTPUT")
+	for _, r := range sortedResults(groups) {
+		fmt.Fprintf(tw, "%s\t%d\t#%d\n", r.Kspace, r.ExitCode, r.Group)
+	}
+	tw.Flush()
+
+	for i, group := range groups {
+		var names []string
+		for _, r := range group {
+			names = append(names, r.Kspace)
+		}
+		fmt.Fprintf(w, "\n#%d (%s)\n", i+1, strings.Join(names, " "))
+		for _, out := range []string{group[0].Stdout, group[0].Stderr} {
+			if out != "" && !strings.HasSuffix(out, "\n") {
+				out += "\n"
+			}
+			fmt.Fprint(w, out)
+		}
+	}
+
+	fmt.Fprintf(w, "\n%s\n", summary)
+	return nil
+}
+
+// sortedResults flattens groups back into a list sorted by kspace
+func sortedResults(groups [][]targetResult) []targetResult {
+	var results []targetResult
+	for _, group := range groups {
+		results = append(results, group...)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Kspace < results[j].Kspace
+	})
+	return results
+}
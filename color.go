@@ -11,11 +11,16 @@ import (
 	"github.com/mattn/go-isatty"
 )
 
-var colorTheme *config.Theme
+var (
+	colorTheme *config.Theme
+	// colorEnabled is true when stdout is a terminal
+	colorEnabled bool
+)
 
 func init() {
 	// Only enable color when stdout is a terminal
 	if isatty.IsTerminal(os.Stdout.Fd()) || isatty.IsCygwinTerminal(os.Stdout.Fd()) {
+		colorEnabled = true
 		goocolor.ForceColor()
 	}
 
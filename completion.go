@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// completeCommand is the hidden command the completion scripts run to get
+// the completions of the word being typed. It answers the way kubectl's
+// __complete does so the rest of the command line can be passed on to it.
+const completeCommand = "__complete"
+
+// completion directives are printed as ":<directive>" after the completions
+const (
+	// directiveError means there are no completions, not even files
+	directiveError = 1
+	// directiveNoSpace keeps the shell from adding a space, e.g. so
+	// +prod can be followed by :namespace
+	directiveNoSpace = 2
+	// directiveNoFileComp stops the shell from completing file names
+	// when there are no completions
+	directiveNoFileComp = 4
+)
+
+// kFlagCompletions are k's own flags with a short description
+var kFlagCompletions = []string{
+	"--k-grep\tonly print lines matching a regex",
+	"--k-timestamps\tprefix streamed lines with their time",
+	"--k-collect\tprint a table of every target's results",
+	"--k-skip-ns-check\tdon't check namespaces exist",
+	"--k-port-template\tlocal ports for multi-target port-forward",
+	"--k-timeout\tkill a target's kubectl after this long",
+	"--k-retries\tretry failed read-only commands",
+	"--k-preflight\tskip targets whose API server doesn't answer",
+	"--k-cache-credentials\tshare exec credentials until they expire",
+}
+
+// runComplete prints the completions for the last of args, the word being
+// typed, and returns the exit code. kspaces and k's flags are completed by
+// k and everything else by kubectl __complete in the first target.
+func runComplete(args []string, w io.Writer) int {
+	toComplete := ""
+	if len(args) > 0 {
+		args, toComplete = args[:len(args)-1], args[len(args)-1]
+	}
+	// PowerShell can't pass an empty argument so it passes "" instead
+	if toComplete == `""` {
+		toComplete = ""
+	}
+
+	binary, err := findKubectl()
+	if err != nil {
+		logger.Debug("not completing", "error", err)
+		fmt.Fprintf(w, ":%d\n", directiveError)
+		return 0
+	}
+	parsed := parseKubectlArgs(args)
+	runner := newRunner(binary, parsed)
+	defaultRunner = runner
+	setNamespaceCacheScope(parsed, runner.kubeconfig)
+
+	// read kubeconfig without running kubectl config view on every tab
+	kubeconfigFiles = runner.kubeconfig
+	if flag, ok := parsed.value("kubeconfig"); ok {
+		kubeconfigFiles = flag
+	}
+	if kubeconfigFiles == "" {
+		kubeconfigFiles = filepath.Join(os.Getenv("HOME"), ".kube", "config")
+	}
+
+	env := envDefaults{
+		context:   os.Getenv("KUBE_CONTEXT"),
+		namespace: os.Getenv("KUBE_NAMESPACE"),
+	}
+	complete(runner, args, toComplete, env, w)
+	return 0
+}
+
+// complete prints the completions for toComplete typed after args
+func complete(runner kubectlRunner, args []string, toComplete string, env envDefaults, w io.Writer) {
+	if strings.HasPrefix(toComplete, "--k-") {
+		printCompletions(w, filterCompletions(kFlagCompletions, toComplete), directiveNoFileComp)
+		return
+	}
+
+	if _, rest, err := extractKFlags(args); err == nil {
+		args = rest
+	}
+	kspaces, rest := splitKspaces(append(append([]string{}, args...), toComplete))
+	if len(kspaces) > 0 && kspaces[len(kspaces)-1] == toComplete && toComplete != "" {
+		completions, directive, err := kspaceCompletions(runner, toComplete, rest, env)
+		if err != nil {
+			logger.Debug("completing kspace", "kspace", toComplete, "error", err)
+			directive = directiveError
+		}
+		printCompletions(w, completions, directive)
+		return
+	}
+
+	completeWithKubectl(runner, args, toComplete, env, w)
+}
+
+// kspaceCompletions completes the last context, cluster or namespace of a
+// kspace. Namespaces are listed in the contexts of the kspace itself so
+// +stage:<tab> completes stage's namespaces rather than the current
+// context's.
+func kspaceCompletions(runner kubectlRunner, toComplete string, args []string, env envDefaults) ([]string, int, error) {
+	kc, err := loadKubeconfig()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	prefix := toComplete[:1]
+	names, namespaces, hasNamespace := strings.Cut(toComplete[1:], ":")
+	if prefix == ":" {
+		names, namespaces, hasNamespace = "", toComplete[1:], true
+	}
+
+	if !hasNamespace {
+		if strings.HasPrefix(toComplete, "+[") {
+			completions, err := tagCompletions(kc, toComplete[2:])
+			return completions, directiveNoSpace | directiveNoFileComp, err
+		}
+		choices := kc.contextNames()
+		if prefix == "@" {
+			choices = kc.clusterNames()
+		}
+		// the list can go on with a comma or be followed by :namespace
+		return listCompletions(prefix, names, choices), directiveNoSpace | directiveNoFileComp, nil
+	}
+
+	targets := []Target{{}}
+	if prefix != ":" {
+		expanded, err := expandKspace(prefix + names)
+		if err != nil {
+			return nil, 0, err
+		}
+		clusters, kSpaceNames, err := ParseCluster([]string{expanded})
+		if err != nil {
+			return nil, 0, err
+		}
+		targets = nil
+		for _, name := range kSpaceNames {
+			targets = append(targets, clusters[name])
+		}
+	}
+
+	list := namespaceLister(runner)
+	seen := make(map[string]bool)
+	var choices []string
+	for _, target := range targets {
+		if target.cluster != "" && target.context == "" {
+			continue
+		}
+		listed, err := list(targetContext(args, target, env), "", false)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, ns := range listed {
+			if !seen[ns] {
+				seen[ns] = true
+				choices = append(choices, ns)
+			}
+		}
+	}
+	sort.Strings(choices)
+
+	head := prefix + names + ":"
+	if prefix == ":" {
+		head = ":"
+	}
+	return listCompletions(head, namespaces, choices), directiveNoFileComp, nil
+}
+
+// tagCompletions completes the last requirement of a tag selector with the
+// tags of the contexts in kc
+func tagCompletions(kc *kubeconfig, selector string) ([]string, error) {
+	cfg, err := loadKConfig()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var tags []string
+	for _, ctx := range kc.Contexts {
+		for key, value := range contextTags(ctx, cfg) {
+			tag := key + "=" + value
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+	}
+	sort.Strings(tags)
+
+	completions := listCompletions("+[", selector, tags)
+	for i := range completions {
+		completions[i] += "]"
+	}
+	return completions, nil
+}
+
+// listCompletions completes the last item of a comma separated list with
+// the choices starting with it. Items already in the list aren't offered
+// again and every completion starts with prefix and the earlier items.
+func listCompletions(prefix string, list string, choices []string) []string {
+	i := strings.LastIndex(list, ",") + 1
+	done, last := list[:i], list[i:]
+
+	typed := make(map[string]bool)
+	for _, item := range strings.Split(done, ",") {
+		typed[item] = true
+	}
+	var completions []string
+	for _, choice := range choices {
+		if strings.HasPrefix(choice, last) && !typed[choice] {
+			completions = append(completions, prefix+done+choice)
+		}
+	}
+	return completions
+}
+
+// completeWithKubectl passes the command line without kspaces to kubectl
+// __complete with the first target's flags, so resources are completed from
+// the cluster the command will run in
+func completeWithKubectl(runner kubectlRunner, args []string, toComplete string, env envDefaults, w io.Writer) {
+	kspaces, rest := splitKspaces(args)
+
+	var target Target
+	if len(kspaces) > 0 {
+		if expanded, err := expandKspace(kspaces[0]); err == nil {
+			if clusters, kSpaceNames, err := ParseCluster([]string{expanded}); err == nil {
+				target = clusters[kSpaceNames[0]]
+			}
+		}
+	}
+	// globs and label selectors only mean something to k
+	if isNamespaceGlob(target.namespace) || isNamespaceSelector(target.namespace) {
+		target.namespace = ""
+	}
+
+	r, err := runnerForContext(runner, targetContext(rest, target, env))
+	if err != nil {
+		logger.Debug("completing with kubectl", "error", err)
+		r = runner
+	}
+	cmdArgs := append([]string{completeCommand}, buildKubectlArgs(rest, target, env)...)
+	cmdArgs = append(cmdArgs, toComplete)
+
+	var stdout bytes.Buffer
+	cmd := r.Command(cmdArgs)
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil && stdout.Len() == 0 {
+		logger.Debug("completing with kubectl", "args", cmdArgs, "error", err)
+		fmt.Fprintf(w, ":%d\n", directiveError)
+		return
+	}
+	w.Write(stdout.Bytes())
+}
+
+// filterCompletions returns the completions starting with toComplete
+func filterCompletions(completions []string, toComplete string) []string {
+	var filtered []string
+	for _, c := range completions {
+		if strings.HasPrefix(c, toComplete) {
+			filtered = append(filtered, c)
+		}
+	}
+	return filtered
+}
+
+// printCompletions prints completions one per line followed by the
+// directive
+func printCompletions(w io.Writer, completions []string, directive int) {
+	for _, c := range completions {
+		fmt.Fprintln(w, c)
+	}
+	fmt.Fprintf(w, ":%d\n", directive)
+}
+
+// completionScripts are printed by k completion <shell>. They run
+// k __complete for every completion.
+var completionScripts = map[string]string{
+	"bash":       bashCompletion,
+	"zsh":        zshCompletion,
+	"fish":       fishCompletion,
+	"powershell": powershellCompletion,
+}
+
+// runCompletion prints the completion script for the shell in args
+func runCompletion(args []string, w io.Writer) int {
+	if len(args) != 1 || completionScripts[args[0]] == "" {
+		logger.Error("usage: k completion bash|zsh|fish|powershell")
+		return 1
+	}
+	io.WriteString(w, completionScripts[args[0]])
+	return 0
+}
+
+const bashCompletion = `# bash completion for k, generated by "k completion bash". Load it with
+#   source <(k completion bash)
+
+__k_complete() {
+    local line="${COMP_LINE:0:COMP_POINT}" cur="" out directive c
+    local -a words
+    read -ra words <<< "$line"
+    if [[ $line != *[[:space:]] ]]; then
+        cur="${words[${#words[@]}-1]}"
+        words=("${words[@]:0:${#words[@]}-1}")
+    fi
+
+    out=$("${words[0]}" __complete "${words[@]:1}" "$cur" 2>/dev/null) || return
+    directive=${out##*:}
+    out=${out%:*}
+    COMPREPLY=()
+    (( directive & 1 )) && return
+
+    # bash splits words at : and = so only the part after them is replaced
+    local trim="${cur%"${COMP_WORDS[COMP_CWORD]}"}"
+    while IFS= read -r c; do
+        c=${c%%$'\t'*}
+        [[ -n $c && $c == "$cur"* ]] && COMPREPLY+=("${c#"$trim"}")
+    done <<< "$out"
+
+    (( directive & 2 )) && compopt -o nospace
+    if (( ${#COMPREPLY[@]} == 0 && !(directive & 4) )); then
+        compopt -o default
+    fi
+}
+
+complete -F __k_complete k
+`
+
+const zshCompletion = `#compdef k
+# zsh completion for k, generated by "k completion zsh". Load it with
+#   source <(k completion zsh)
+# or save it as _k in a directory on $fpath.
+
+_k() {
+    local out directive line value
+    local -a completions
+    out=$(${words[1]} __complete "${(@Q)words[2,CURRENT-1]}" "${(Q)words[CURRENT]}" 2>/dev/null) || return
+    directive=${out##*:}
+    out=${out%:*}
+    (( directive & 1 )) && return 1
+
+    for line in ${(f)out}; do
+        value=${line%%$'\t'*}
+        if [[ $line == *$'\t'* ]]; then
+            completions+=("${value//:/\\:}:${line#*$'\t'}")
+        else
+            completions+=("${value//:/\\:}")
+        fi
+    done
+
+    if (( ${#completions} == 0 )); then
+        (( directive & 4 )) || _files
+        return
+    fi
+    if (( directive & 2 )); then
+        _describe -t k-completions 'k completions' completions -S ''
+    else
+        _describe -t k-completions 'k completions' completions
+    fi
+}
+
+if [ "$funcstack[1]" = "_k" ]; then
+    _k "$@"
+else
+    compdef _k k
+fi
+`
+
+const fishCompletion = `# fish completion for k, generated by "k completion fish". Load it with
+#   k completion fish | source
+
+function __k_complete
+    set -l args (commandline -opc)
+    set -l cur (commandline -ct)
+    set -l out ($args[1] __complete $args[2..-1] $cur 2>/dev/null)
+    or return
+    test (count $out) -gt 0
+    or return
+
+    set -l directive (string replace ':' '' -- $out[-1])
+    set -e out[-1]
+    if test (math "bitand($directive, 1)") -ne 0
+        return
+    end
+
+    if test (count $out) -eq 0
+        if test (math "bitand($directive, 4)") -eq 0
+            __fish_complete_path $cur
+        end
+        return
+    end
+
+    printf '%s\n' $out
+    # fish adds a space after the only completion, a second one a
+    # character longer stops it
+    if test (count $out) -eq 1; and test (math "bitand($directive, 2)") -ne 0
+        printf '%s.\n' (string split -m1 \t -- $out[1])[1]
+    end
+end
+
+complete -c k -e
+complete -c k -f -a '(__k_complete)'
+`
+
+const powershellCompletion = `# powershell completion for k, generated by "k completion powershell".
+# Load it with
+#   k completion powershell | Out-String | Invoke-Expression
+
+Register-ArgumentCompleter -Native -CommandName k -ScriptBlock {
+    param($wordToComplete, $commandAst, $cursorPosition)
+
+    $line = "$commandAst"
+    if ($line.Length -gt $cursorPosition) {
+        $line = $line.Substring(0, $cursorPosition)
+    }
+    $program, $arguments = $line.Split(" ", 2)
+    $request = "$program __complete $arguments"
+    if ($wordToComplete -eq "") {
+        # an empty argument isn't passed to native commands
+        $request += ' ` + "`\"`\"" + `'
+    }
+    $out = @(Invoke-Expression "$request 2>` + "`$null" + `")
+    if ($out.Count -eq 0) {
+        return
+    }
+
+    $directive = [int]$out[-1].TrimStart(':')
+    $out = @($out | Select-Object -SkipLast 1)
+    if ($directive -band 1) {
+        return
+    }
+
+    $out | Where-Object { $_.StartsWith($wordToComplete) } | ForEach-Object {
+        $value, $description = $_.Split("` + "`t" + `", 2)
+        if (-not $description) {
+            $description = $value
+        }
+        $text = $value
+        if (-not ($directive -band 2)) {
+            $text += " "
+        }
+        [System.Management.Automation.CompletionResult]::new($text, $value, 'ParameterValue', $description)
+    }
+}
+`
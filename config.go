@@ -0,0 +1,428 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// kubeconfigExtension is the name of the kubeconfig context extension k
+// reads tags from
+const kubeconfigExtension = "k"
+
+/*
+kConfig is k's own config file. It's read from $K_CONFIG or
+$XDG_CONFIG_HOME/k/config.yaml and looks like
+
+	contexts:
+	- name: "gke_*"
+	  tags:
+	    provider: gke
+	- name: prod-eu
+	  tags:
+	    env: prod
+	    region: eu
+	- name: legacy-*
+	  kubectl: kubectl-1.27
+	- selector: provider=eks,env=prod
+	  env:
+	    AWS_PROFILE: prod
+	- name: private-*
+	  tunnel:
+	    command: [ssh, -N, -D, "{port}", bastion]
+
+Every rule whose name (a context name or glob) and tag selector match a
+context applies to it, in order, so later rules override earlier ones. Tags
+only come from rules matched by name.
+*/
+type kConfig struct {
+	Contexts []contextRule `yaml:"contexts"`
+}
+
+// contextRule holds settings for the contexts matching name
+type contextRule struct {
+	Name string            `yaml:"name"`
+	Tags map[string]string `yaml:"tags"`
+	// Selector is a tag selector like env=prod. A rule with a selector
+	// only applies to contexts with matching tags.
+	Selector string `yaml:"selector"`
+	// Kubectl is the kubectl binary (a name on PATH or a path) used for
+	// the contexts, e.g. an older kubectl for an older cluster
+	Kubectl string `yaml:"kubectl"`
+	// Env is added to the environment of kubectl for the contexts, e.g.
+	// AWS_PROFILE for exec credential plugins
+	Env map[string]string `yaml:"env"`
+	// Tunnel is a proxy or tunnel command used to reach the contexts
+	Tunnel *tunnelConfig `yaml:"tunnel"`
+}
+
+var (
+	loadedKConfig *kConfig
+	kConfigErr    error
+	kConfigOnce   sync.Once
+)
+
+// kConfigPath returns the path to k's config file
+func kConfigPath() string {
+	if p, ok := os.LookupEnv("K_CONFIG"); ok {
+		return p
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "k", "config.yaml")
+}
+
+// loadKConfig reads k's config file once. A missing file is an empty config.
+func loadKConfig() (*kConfig, error) {
+	kConfigOnce.Do(func() {
+		loadedKConfig = &kConfig{}
+		p := kConfigPath()
+		if p == "" {
+			return
+		}
+		data, err := os.ReadFile(p)
+		if os.IsNotExist(err) {
+			return
+		} else if err != nil {
+			kConfigErr = err
+			return
+		}
+		if err := yaml.Unmarshal(data, loadedKConfig); err != nil {
+			kConfigErr = fmt.Errorf("parsing %s: %w", p, err)
+		}
+	})
+	return loadedKConfig, kConfigErr
+}
+
+// matches checks if the rule applies to context
+func (r contextRule) matches(context string) bool {
+	if r.Name == context {
+		return true
+	}
+	ok, _ := path.Match(r.Name, context)
+	return ok
+}
+
+// contextTags returns the tags of a context. Tags come from the "k" extension
+// of the context in kubeconfig and are overridden by the k config file.
+func contextTags(ctx namedContext, cfg *kConfig) map[string]string {
+	tags := make(map[string]string)
+	for _, ext := range ctx.Context.Extensions {
+		if ext.Name != kubeconfigExtension {
+			continue
+		}
+		// the extension can be the tags themselves or {tags: {...}}
+		var wrapped struct {
+			Tags map[string]string `json:"tags"`
+		}
+		if err := json.Unmarshal(ext.Extension, &wrapped); err == nil && wrapped.Tags != nil {
+			for k, v := range wrapped.Tags {
+				tags[k] = v
+			}
+			continue
+		}
+		var plain map[string]string
+		if err := json.Unmarshal(ext.Extension, &plain); err == nil {
+			for k, v := range plain {
+				tags[k] = v
+			}
+		}
+	}
+
+	if cfg != nil {
+		for _, rule := range cfg.Contexts {
+			if rule.matches(ctx.Name) {
+				for k, v := range rule.Tags {
+					tags[k] = v
+				}
+			}
+		}
+	}
+	return tags
+}
+
+// appliesTo checks if a rule's name and tag selector both match a context.
+// A rule needs at least one of them.
+func (r contextRule) appliesTo(ctx namedContext, tags map[string]string) (bool, error) {
+	if r.Name != "" && !r.matches(ctx.Name) {
+		return false, nil
+	}
+	if r.Selector == "" {
+		return r.Name != "", nil
+	}
+	reqs, err := parseTagSelector(r.Selector)
+	if err != nil {
+		return false, fmt.Errorf("context rule %q: %w", r.Name, err)
+	}
+	return matchTags(reqs, tags), nil
+}
+
+// contextSettings merges the rules in cfg that apply to a context. Later
+// rules override earlier ones.
+func contextSettings(ctx namedContext, cfg *kConfig) (contextRule, error) {
+	settings := contextRule{Name: ctx.Name, Env: make(map[string]string)}
+	if cfg == nil {
+		return settings, nil
+	}
+	tags := contextTags(ctx, cfg)
+	for _, rule := range cfg.Contexts {
+		ok, err := rule.appliesTo(ctx, tags)
+		if err != nil {
+			return settings, err
+		}
+		if !ok {
+			continue
+		}
+		if rule.Kubectl != "" {
+			settings.Kubectl = rule.Kubectl
+		}
+		for k, v := range rule.Env {
+			settings.Env[k] = os.ExpandEnv(v)
+		}
+		if rule.Tunnel != nil {
+			settings.Tunnel = rule.Tunnel
+		}
+	}
+	return settings, nil
+}
+
+// runnerForContext returns base with the kubectl binary and the extra
+// environment the k config sets for context. A tunnel for the context is
+// started here so it's up before kubectl runs. An empty context is the
+// current context.
+func runnerForContext(base kubectlRunner, context string) (kubectlRunner, error) {
+	x := base
+	cfg, err := loadKConfig()
+	if err != nil {
+		return x, err
+	}
+	// only read kubeconfig when a rule could change something
+	configured := false
+	for _, rule := range cfg.Contexts {
+		configured = configured || rule.Kubectl != "" || len(rule.Env) > 0 || rule.Tunnel != nil
+	}
+	if !configured {
+		return x, nil
+	}
+
+	kc, err := loadKubeconfig()
+	if err != nil {
+		return x, err
+	}
+	if context == "" {
+		context = kc.CurrentContext
+	}
+	ctx := namedContext{Name: context}
+	for _, c := range kc.Contexts {
+		if c.Name == context {
+			ctx = c
+		}
+	}
+
+	settings, err := contextSettings(ctx, cfg)
+	if err != nil {
+		return x, err
+	}
+	if settings.Tunnel != nil {
+		proxy, err := openTunnel(*settings.Tunnel)
+		if err != nil {
+			return x, fmt.Errorf("tunnel for context %s: %w", context, err)
+		}
+		settings.Env["HTTPS_PROXY"] = proxy
+	}
+	for _, k := range sortedKeys(settings.Env) {
+		x.env = append(x.env, k+"="+settings.Env[k])
+	}
+	if settings.Kubectl == "" {
+		return x, nil
+	}
+	binary := settings.Kubectl
+	if strings.HasPrefix(binary, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			binary = filepath.Join(home, binary[2:])
+		}
+	}
+	x.binary, err = exec.LookPath(binary)
+	if err != nil {
+		return x, fmt.Errorf("kubectl for context %s: %w", context, err)
+	}
+	return x, nil
+}
+
+// sortedKeys returns the keys of a string map in order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// tagRequirement is one term of a tag selector
+type tagRequirement struct {
+	key      string
+	value    string
+	operator string // "=", "!=" or "" when the key only has to exist
+}
+
+// parseTagSelector parses a selector like env=prod,region!=us,gpu
+func parseTagSelector(s string) ([]tagRequirement, error) {
+	var reqs []tagRequirement
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		var req tagRequirement
+		if k, v, ok := strings.Cut(term, "!="); ok {
+			req = tagRequirement{key: k, value: v, operator: "!="}
+		} else if k, v, ok := strings.Cut(term, "="); ok {
+			req = tagRequirement{key: k, value: strings.TrimPrefix(v, "="), operator: "="}
+		} else {
+			req = tagRequirement{key: term}
+		}
+		if req.key == "" {
+			return nil, fmt.Errorf("invalid tag selector %q", s)
+		}
+		reqs = append(reqs, req)
+	}
+	if len(reqs) == 0 {
+		return nil, fmt.Errorf("empty tag selector")
+	}
+	return reqs, nil
+}
+
+// matchTags checks if tags satisfy every requirement
+func matchTags(reqs []tagRequirement, tags map[string]string) bool {
+	for _, req := range reqs {
+		v, ok := tags[req.key]
+		switch req.operator {
+		case "=":
+			if !ok || v != req.value {
+				return false
+			}
+		case "!=":
+			if ok && v == req.value {
+				return false
+			}
+		default:
+			if !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isTagKspace checks if a kspace selects contexts by tag like +[env=prod]
+func isTagKspace(kspace string) bool {
+	return strings.HasPrefix(kspace, "+[") && strings.Contains(kspace, "]")
+}
+
+// expandTagKspace replaces the tag selector in kspace with the names of the
+// matching contexts, e.g. +[env=prod]:default becomes +prod-eu,prod-us:default
+func expandTagKspace(kspace string, contexts []namedContext, cfg *kConfig) (string, error) {
+	end := strings.Index(kspace, "]")
+	selector, rest := kspace[2:end], kspace[end+1:]
+	if rest != "" && !strings.HasPrefix(rest, ":") {
+		return "", fmt.Errorf("unexpected %q after tag selector in %s", rest, kspace)
+	}
+
+	reqs, err := parseTagSelector(selector)
+	if err != nil {
+		return "", err
+	}
+
+	var matched []string
+	for _, ctx := range contexts {
+		if matchTags(reqs, contextTags(ctx, cfg)) {
+			matched = append(matched, ctx.Name)
+		}
+	}
+	if len(matched) == 0 {
+		return "", fmt.Errorf("no contexts match tags [%s]", selector)
+	}
+	sort.Strings(matched)
+	return "+" + strings.Join(matched, ",") + rest, nil
+}
+
+// expandTagKspaceFromConfig expands a tag kspace using the merged kubeconfig
+// and the k config file
+func expandTagKspaceFromConfig(kspace string) (string, error) {
+	kc, err := loadKubeconfig()
+	if err != nil {
+		return "", err
+	}
+	cfg, err := loadKConfig()
+	if err != nil {
+		return "", err
+	}
+	return expandTagKspace(kspace, kc.Contexts, cfg)
+}
+
+// isContextGlob checks if a kspace selects contexts by a glob like +prod-*
+func isContextGlob(kspace string) bool {
+	if !strings.HasPrefix(kspace, "+") || isTagKspace(kspace) {
+		return false
+	}
+	contexts, _, _ := strings.Cut(kspace[1:], ":")
+	return strings.ContainsAny(contexts, "*?[")
+}
+
+// expandContextGlob replaces context globs in kspace with the names of the
+// matching contexts, e.g. +prod-*:default becomes +prod-eu,prod-us:default
+func expandContextGlob(kspace string, contexts []string) (string, error) {
+	list, rest, hasNamespace := strings.Cut(kspace[1:], ":")
+	var expanded []string
+	for _, pattern := range strings.Split(list, ",") {
+		if !strings.ContainsAny(pattern, "*?[") {
+			expanded = append(expanded, pattern)
+			continue
+		}
+		var matched []string
+		for _, name := range contexts {
+			if ok, _ := path.Match(pattern, name); ok {
+				matched = append(matched, name)
+			}
+		}
+		if len(matched) == 0 {
+			return "", fmt.Errorf("no contexts match %q", pattern)
+		}
+		sort.Strings(matched)
+		expanded = append(expanded, matched...)
+	}
+	kspace = "+" + strings.Join(expanded, ",")
+	if hasNamespace {
+		kspace += ":" + rest
+	}
+	return kspace, nil
+}
+
+// expandKspace replaces tag selectors and context globs in kspace with the
+// names of the contexts they match. Other kspaces are returned as they are.
+func expandKspace(kspace string) (string, error) {
+	switch {
+	case isTagKspace(kspace):
+		// +[env=prod] selects contexts by their tags
+		return expandTagKspaceFromConfig(kspace)
+	case isContextGlob(kspace):
+		// +prod-* selects contexts by name
+		kc, err := loadKubeconfig()
+		if err != nil {
+			return "", err
+		}
+		return expandContextGlob(kspace, kc.contextNames())
+	}
+	return kspace, nil
+}
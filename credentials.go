@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// credentialShimCommand is the hidden command kubectl runs instead of
+	// an exec credential plugin when credentials are cached
+	credentialShimCommand = "__exec-credential"
+	// credentialExpirySkew is how long before it expires a cached
+	// credential is no longer used
+	credentialExpirySkew = time.Minute
+	// credentialLockTimeout is how long a shim waits for another one to
+	// fetch the same credential
+	credentialLockTimeout = 2 * time.Minute
+)
+
+// credentialEnvPrefixes start the environment variables that choose which
+// identity cloud credential plugins like aws, gcloud and az return
+var credentialEnvPrefixes = []string{"AWS_", "AZURE_", "ARM_", "CLOUDSDK_", "GOOGLE_"}
+
+// namedUser is a kubeconfig user. User is kept as is so its exec config can
+// be copied without knowing every field.
+type namedUser struct {
+	Name string          `json:"name"`
+	User json.RawMessage `json:"user"`
+}
+
+// credentialCacheDir returns where exec credentials are cached
+func credentialCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "k", "credentials")
+}
+
+// shimKubeconfig returns a kubeconfig that replaces the exec plugin of every
+// user in users with the credential shim run by self. Users that set
+// anything besides exec, or whose plugin is a relative path, are left alone.
+// kubeconfigPath is the KUBECONFIG the users were read from.
+func shimKubeconfig(users []namedUser, self, kubeconfigPath string) ([]byte, int, error) {
+	var shimmed []map[string]any
+	for _, u := range users {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(u.User, &fields); err != nil {
+			continue
+		}
+		if len(fields) != 1 || fields["exec"] == nil {
+			continue
+		}
+		var execConfig map[string]any
+		if err := json.Unmarshal(fields["exec"], &execConfig); err != nil {
+			continue
+		}
+		command, _ := execConfig["command"].(string)
+		// kubectl resolves relative paths from the kubeconfig file's directory
+		if command == "" || (strings.ContainsRune(command, filepath.Separator) && !filepath.IsAbs(command)) {
+			continue
+		}
+
+		// the cache key covers the kubeconfig and the whole exec config,
+		// env included. The shim adds the environment it's run with.
+		sum := sha256.Sum256(append([]byte(kubeconfigPath+"\x00"+u.Name+"\x00"), fields["exec"]...))
+		shimArgs := []string{credentialShimCommand, hex.EncodeToString(sum[:12]), "--", command}
+		if args, ok := execConfig["args"].([]any); ok {
+			for _, a := range args {
+				shimArgs = append(shimArgs, fmt.Sprint(a))
+			}
+		}
+		execConfig["command"] = self
+		execConfig["args"] = shimArgs
+
+		shimmed = append(shimmed, map[string]any{
+			"name": u.Name,
+			"user": map[string]any{"exec": execConfig},
+		})
+	}
+
+	data, err := json.Marshal(map[string]any{
+		"apiVersion": "v1",
+		"kind":       "Config",
+		"users":      shimmed,
+	})
+	return data, len(shimmed), err
+}
+
+// setupCredentialCache puts a kubeconfig in front of kubeconfigPath that
+// sends exec credential plugins through the shim and returns the new
+// KUBECONFIG. The kubeconfig is removed when k exits.
+func setupCredentialCache(kubeconfigPath string) (string, error) {
+	kc, err := loadKubeconfig()
+	if err != nil {
+		return kubeconfigPath, err
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return kubeconfigPath, err
+	}
+	data, n, err := shimKubeconfig(kc.Users, self, kubeconfigPath)
+	if err != nil || n == 0 {
+		return kubeconfigPath, err
+	}
+
+	f, err := os.CreateTemp("", "k-kubeconfig-*.json")
+	if err != nil {
+		return kubeconfigPath, err
+	}
+	atExit(func() { os.Remove(f.Name()) })
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return kubeconfigPath, err
+	}
+	if err := f.Close(); err != nil {
+		return kubeconfigPath, err
+	}
+	// the first file to define a user wins, so the shim replaces the plugin
+	if kubeconfigPath == "" {
+		return f.Name(), nil
+	}
+	return f.Name() + string(os.PathListSeparator) + kubeconfigPath, nil
+}
+
+// credentialCacheKey adds the cloud credential variables and the variables
+// set by the k config in the environment to key, so runs and contexts with
+// different AWS_PROFILEs don't share credentials
+func credentialCacheKey(key string) string {
+	names := make(map[string]bool)
+	if cfg, err := loadKConfig(); err == nil {
+		for _, rule := range cfg.Contexts {
+			for k := range rule.Env {
+				names[k] = true
+			}
+		}
+	}
+	var env []string
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if names[name] || hasCredentialEnvPrefix(name) {
+			env = append(env, kv)
+		}
+	}
+	sort.Strings(env)
+
+	h := sha256.New()
+	h.Write([]byte(key))
+	for _, kv := range env {
+		fmt.Fprintf(h, "\x00%s", kv)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:12])
+}
+
+// hasCredentialEnvPrefix reports whether name starts with one of
+// credentialEnvPrefixes
+func hasCredentialEnvPrefix(name string) bool {
+	for _, prefix := range credentialEnvPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// cachedCredential returns a cached ExecCredential if it's still valid
+func cachedCredential(p string) ([]byte, bool) {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, false
+	}
+	expires, ok := credentialExpiry(data)
+	if !ok || time.Until(expires) < credentialExpirySkew {
+		return nil, false
+	}
+	return data, true
+}
+
+// credentialExpiry returns when an ExecCredential expires. Credentials
+// without an expiry aren't cached.
+func credentialExpiry(data []byte) (time.Time, bool) {
+	var cred struct {
+		Status struct {
+			ExpirationTimestamp time.Time `json:"expirationTimestamp"`
+		} `json:"status"`
+	}
+	if err := json.Unmarshal(data, &cred); err != nil || cred.Status.ExpirationTimestamp.IsZero() {
+		return time.Time{}, false
+	}
+	return cred.Status.ExpirationTimestamp, true
+}
+
+// lockFile creates a lock file, waiting while another process holds it. The
+// returned func removes it.
+func lockFile(p string) (func(), error) {
+	deadline := time.Now().Add(credentialLockTimeout)
+	for {
+		f, err := os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(p) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		// a lock older than the timeout was left by a shim that died
+		if info, err := os.Stat(p); err == nil && time.Since(info.ModTime()) > credentialLockTimeout {
+			os.Remove(p)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.New("timed out waiting for " + p)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// runCredentialShim is run by kubectl in place of an exec credential plugin.
+// args are the cache key, "--" and the plugin command. Credentials are
+// served from the cache until they expire, and only one shim at a time
+// runs the plugin for a key so concurrent kubectls share its result.
+func runCredentialShim(args []string, stdout io.Writer) int {
+	if len(args) < 3 || args[1] != "--" {
+		fmt.Fprintf(os.Stderr, "usage: k %s <key> -- <command> [args...]\n", credentialShimCommand)
+		return 1
+	}
+	key, command := credentialCacheKey(args[0]), args[2:]
+
+	dir := credentialCacheDir()
+	p := filepath.Join(dir, key+".json")
+	if dir != "" {
+		if cred, ok := cachedCredential(p); ok {
+			stdout.Write(cred)
+			return 0
+		}
+		if err := os.MkdirAll(dir, 0o700); err == nil {
+			if unlock, err := lockFile(p + ".lock"); err == nil {
+				defer unlock()
+				// another shim may have fetched it while we waited
+				if cred, ok := cachedCredential(p); ok {
+					stdout.Write(cred)
+					return 0
+				}
+			}
+		}
+	}
+
+	var out bytes.Buffer
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	stdout.Write(out.Bytes())
+	if err != nil {
+		if exitError, ok := err.(*exec.ExitError); ok {
+			return exitError.ExitCode()
+		}
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if _, ok := credentialExpiry(out.Bytes()); ok && dir != "" {
+		// write then rename so other shims never read half a credential
+		tmp := p + ".tmp"
+		if err := os.WriteFile(tmp, out.Bytes(), 0o600); err == nil {
+			os.Rename(tmp, p)
+		}
+	}
+	return 0
+}
@@ -32,9 +32,10 @@
           nativeBuildInputs = [ pkgs.installShellFiles ];
 
           postInstall = ''
-            installShellCompletion --bash completions/bash/k
-            installShellCompletion --fish completions/fish/k.fish
-            installShellCompletion --zsh completions/zsh/_k
+            installShellCompletion --cmd k \
+              --bash <($out/bin/k completion bash) \
+              --fish <($out/bin/k completion fish) \
+              --zsh <($out/bin/k completion zsh)
           '';
 
           meta = with pkgs.lib; {
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// kOptions holds k's own flags. They are always spelled --k-<name> so they
+// can't collide with kubectl flags, and they are removed from the argument
+// list before kubectl is run.
+type kOptions struct {
+	// grep only prints multiplexed lines matching this pattern (--k-grep)
+	grep *regexp.Regexp
+	// timestamps prefixes multiplexed lines with their arrival time (--k-timestamps)
+	timestamps bool
+	// portTemplate picks local ports for multi-target port-forward (--k-port-template)
+	portTemplate string
+	// collect captures every target's output and prints a summary as
+	// "table" or "json" (--k-collect)
+	collect string
+	// skipNamespaceCheck passes :namespace through without checking it
+	// exists in the target (--k-skip-ns-check)
+	skipNamespaceCheck bool
+	// cacheCredentials runs exec credential plugins through k so their
+	// credentials are shared until they expire (--k-cache-credentials)
+	cacheCredentials bool
+	// preflight checks every target's API server answers within this
+	// timeout and skips the ones that don't (--k-preflight[=timeout])
+	preflight time.Duration
+	// timeout kills a target's kubectl when it runs longer (--k-timeout)
+	timeout time.Duration
+	// retries runs failed read-only commands again (--k-retries)
+	retries int
+}
+
+var kOpts kOptions
+
+// extractKFlags removes all --k-* flags from args and returns the parsed
+// options along with the remaining arguments. Anything after "--" is left
+// untouched because it belongs to the command run by kubectl.
+func extractKFlags(args []string) (kOptions, []string, error) {
+	var opts kOptions
+	var rest []string
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			rest = append(rest, args[i:]...)
+			break
+		}
+		if !strings.HasPrefix(arg, "--k-") {
+			rest = append(rest, arg)
+			continue
+		}
+
+		name, value, hasValue := strings.Cut(arg, "=")
+		// nextValue returns the flag value from either --k-flag=value or --k-flag value
+		nextValue := func() (string, error) {
+			if hasValue {
+				return value, nil
+			}
+			if i+1 >= len(args) {
+				return "", fmt.Errorf("flag %s requires a value", name)
+			}
+			i++
+			return args[i], nil
+		}
+		// boolValue returns true unless the flag was given as --k-flag=false
+		boolValue := func() (bool, error) {
+			if !hasValue {
+				return true, nil
+			}
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return false, fmt.Errorf("invalid value for %s: %q", name, value)
+			}
+			return b, nil
+		}
+
+		var err error
+
+		switch name {
+		case "--k-grep":
+			v, err := nextValue()
+			if err != nil {
+				return opts, nil, err
+			}
+			re, err := regexp.Compile(v)
+			if err != nil {
+				return opts, nil, fmt.Errorf("invalid --k-grep pattern: %w", err)
+			}
+			opts.grep = re
+		case "--k-collect":
+			// the value is optional so it has to be given with =
+			opts.collect = "table"
+			if hasValue {
+				if value != "table" && value != "json" {
+					return opts, nil, fmt.Errorf("--k-collect must be table or json: %q", value)
+				}
+				opts.collect = value
+			}
+		case "--k-port-template":
+			v, err := nextValue()
+			if err != nil {
+				return opts, nil, err
+			}
+			if !strings.Contains(v, "{idx}") {
+				return opts, nil, fmt.Errorf("--k-port-template must contain {idx}: %q", v)
+			}
+			opts.portTemplate = v
+		case "--k-skip-ns-check":
+			if opts.skipNamespaceCheck, err = boolValue(); err != nil {
+				return opts, nil, err
+			}
+		case "--k-preflight":
+			// the timeout is optional so it has to be given with =
+			opts.preflight = defaultProbeTimeout
+			if hasValue {
+				d, err := time.ParseDuration(value)
+				if err != nil || d <= 0 {
+					return opts, nil, fmt.Errorf("invalid --k-preflight timeout: %q", value)
+				}
+				opts.preflight = d
+			}
+		case "--k-timeout":
+			v, err := nextValue()
+			if err != nil {
+				return opts, nil, err
+			}
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				return opts, nil, fmt.Errorf("invalid --k-timeout: %q", v)
+			}
+			opts.timeout = d
+		case "--k-retries":
+			v, err := nextValue()
+			if err != nil {
+				return opts, nil, err
+			}
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return opts, nil, fmt.Errorf("invalid --k-retries: %q", v)
+			}
+			opts.retries = n
+		case "--k-cache-credentials":
+			if opts.cacheCredentials, err = boolValue(); err != nil {
+				return opts, nil, err
+			}
+		case "--k-timestamps":
+			if opts.timestamps, err = boolValue(); err != nil {
+				return opts, nil, err
+			}
+		default:
+			return opts, nil, fmt.Errorf("unknown k flag: %s", name)
+		}
+	}
+
+	return opts, rest, nil
+}
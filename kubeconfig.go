@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// kubeconfig is the part of the merged kubeconfig k cares about. It's read
+// with `kubectl config view` so kubectl's own merging rules apply.
+type kubeconfig struct {
+	CurrentContext string           `json:"current-context"`
+	Contexts       []namedContext   `json:"contexts"`
+	Clusters       []namedCluster   `json:"clusters"`
+	Users          []namedUser      `json:"users"`
+	Extensions     []namedExtension `json:"extensions"`
+}
+
+type namedContext struct {
+	Name    string `json:"name"`
+	Context struct {
+		Cluster    string           `json:"cluster"`
+		Namespace  string           `json:"namespace"`
+		User       string           `json:"user"`
+		Extensions []namedExtension `json:"extensions"`
+	} `json:"context"`
+}
+
+type namedCluster struct {
+	Name    string `json:"name"`
+	Cluster struct {
+		Server     string           `json:"server"`
+		Extensions []namedExtension `json:"extensions"`
+	} `json:"cluster"`
+}
+
+type namedExtension struct {
+	Name      string          `json:"name"`
+	Extension json.RawMessage `json:"extension"`
+}
+
+var (
+	loadedKubeconfig *kubeconfig
+	kubeconfigErr    error
+	kubeconfigOnce   sync.Once
+)
+
+// kubeconfigFiles makes loadKubeconfig read this KUBECONFIG path list
+// itself instead of running kubectl config view. Completion sets it since
+// every tab runs a new k.
+var kubeconfigFiles string
+
+// loadKubeconfig returns the merged kubeconfig. It's only read once per run.
+func loadKubeconfig() (*kubeconfig, error) {
+	kubeconfigOnce.Do(func() {
+		if kubeconfigFiles != "" {
+			loadedKubeconfig, kubeconfigErr = readKubeconfigFiles(kubeconfigFiles)
+			return
+		}
+		var stdout, stderr bytes.Buffer
+		cmd := defaultRunner.Command([]string{"config", "view", "--output", "json"})
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			kubeconfigErr = fmt.Errorf("reading kubeconfig: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+			return
+		}
+		loadedKubeconfig = &kubeconfig{}
+		kubeconfigErr = json.Unmarshal(stdout.Bytes(), loadedKubeconfig)
+	})
+	return loadedKubeconfig, kubeconfigErr
+}
+
+// readKubeconfigFiles merges the files in a KUBECONFIG path list like
+// kubectl does: the first file to set the current context or to define a
+// context, cluster, user or extension wins and missing files are skipped
+func readKubeconfigFiles(kubeconfigPath string) (*kubeconfig, error) {
+	merged := &kubeconfig{}
+	seen := make(map[string]bool)
+	// first reports whether kind/name hasn't been defined by an earlier file
+	first := func(kind string, name string) bool {
+		if seen[kind+"/"+name] {
+			return false
+		}
+		seen[kind+"/"+name] = true
+		return true
+	}
+
+	for _, p := range filepath.SplitList(kubeconfigPath) {
+		if p == "" {
+			continue
+		}
+		data, err := os.ReadFile(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		// kubeconfig files are YAML with the same fields config view prints
+		var doc any
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", p, err)
+		}
+		asJSON, err := json.Marshal(doc)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", p, err)
+		}
+		var kc kubeconfig
+		if err := json.Unmarshal(asJSON, &kc); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", p, err)
+		}
+
+		if merged.CurrentContext == "" {
+			merged.CurrentContext = kc.CurrentContext
+		}
+		for _, c := range kc.Contexts {
+			if first("context", c.Name) {
+				merged.Contexts = append(merged.Contexts, c)
+			}
+		}
+		for _, c := range kc.Clusters {
+			if first("cluster", c.Name) {
+				merged.Clusters = append(merged.Clusters, c)
+			}
+		}
+		for _, u := range kc.Users {
+			if first("user", u.Name) {
+				merged.Users = append(merged.Users, u)
+			}
+		}
+		for _, e := range kc.Extensions {
+			if first("extension", e.Name) {
+				merged.Extensions = append(merged.Extensions, e)
+			}
+		}
+	}
+	return merged, nil
+}
+
+// contextNames returns the names of all contexts in the kubeconfig
+func (kc *kubeconfig) contextNames() []string {
+	var names []string
+	for _, c := range kc.Contexts {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+// clusterNames returns the names of all clusters in the kubeconfig
+func (kc *kubeconfig) clusterNames() []string {
+	var names []string
+	for _, c := range kc.Clusters {
+		names = append(names, c.Name)
+	}
+	return names
+}
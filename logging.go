@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// logger is where k's own messages go. They're always written to stderr so
+// they never end up mixed into kubectl's output. K_LOG_LEVEL picks the
+// lowest level printed and K_LOG_FORMAT=json prints one JSON object per
+// message for wrappers that parse them.
+var logger = newLogger(os.Stderr, os.Getenv("K_LOG_FORMAT"), logLevel())
+
+// logLevel returns the level from K_LOG_LEVEL. K_DEBUG still turns on debug
+// messages the way it did before K_LOG_LEVEL.
+func logLevel() slog.Level {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(os.Getenv("K_LOG_LEVEL"))); err != nil {
+		level = slog.LevelInfo
+	}
+	if _, ok := os.LookupEnv("K_DEBUG"); ok {
+		level = slog.LevelDebug
+	}
+	return level
+}
+
+// newLogger returns a logger writing to w in format ("json" or "text")
+func newLogger(w io.Writer, format string, level slog.Level) *slog.Logger {
+	if strings.EqualFold(format, "json") {
+		return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level}))
+	}
+	// share the output lock so messages don't interleave with kubectl lines
+	return slog.New(&textHandler{w: w, level: level, mu: &outputMu})
+}
+
+// textHandler prints messages the way k always has: "Error: msg" and
+// "Warning: msg", "[DEBUG] msg" and info messages as they are. Attributes
+// follow the message as key=value, except kspace which is printed in front
+// like the prefix of the target's kubectl output.
+type textHandler struct {
+	w     io.Writer
+	level slog.Level
+	attrs []slog.Attr
+	mu    *sync.Mutex
+}
+
+func (h *textHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *textHandler) Handle(_ context.Context, r slog.Record) error {
+	var kspace string
+	var attrs []slog.Attr
+	collect := func(a slog.Attr) bool {
+		if a.Key == "kspace" {
+			kspace = a.Value.String()
+		} else {
+			attrs = append(attrs, a)
+		}
+		return true
+	}
+	for _, a := range h.attrs {
+		collect(a)
+	}
+	r.Attrs(collect)
+
+	var b strings.Builder
+	if kspace != "" {
+		b.WriteString(formatPrefix(kspace) + "  ")
+	}
+	switch {
+	case r.Level >= slog.LevelError:
+		b.WriteString("Error: ")
+	case r.Level >= slog.LevelWarn:
+		b.WriteString("Warning: ")
+	case r.Level < slog.LevelInfo:
+		b.WriteString("[DEBUG] ")
+	}
+	b.WriteString(r.Message)
+	for _, a := range attrs {
+		value := a.Value.String()
+		if strings.ContainsAny(value, " \"=") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&b, " %s=%s", a.Key, value)
+	}
+	b.WriteString("\n")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	withAttrs := *h
+	withAttrs.attrs = append(append([]slog.Attr{}, h.attrs...), attrs...)
+	return &withAttrs
+}
+
+// WithGroup isn't used by k, groups are flattened into the message
+func (h *textHandler) WithGroup(string) slog.Handler {
+	return h
+}
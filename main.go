@@ -1,30 +1,65 @@
 package main
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/rothgar/k/pkg/kspace"
 )
 
+var version = "devel"
+
 var (
-	kubeEnv       = ""
-	version       = "devel"
-	kubectlBinary = ""
+	// exitHooks clean up before k exits, e.g. by stopping tunnels
+	exitHooks     []func()
+	exitHooksMu   sync.Mutex
+	exitHooksOnce sync.Once
 )
 
-func init() {
-	log.SetFlags(0)
-	_, err := exec.LookPath("kubectl")
-	if err != nil {
-		log.Fatalln(err)
+// atExit registers fn to run before k exits
+func atExit(fn func()) {
+	exitHooksMu.Lock()
+	defer exitHooksMu.Unlock()
+	exitHooks = append(exitHooks, fn)
+}
+
+// runExitHooks runs the registered exit hooks once
+func runExitHooks() {
+	exitHooksOnce.Do(func() {
+		exitHooksMu.Lock()
+		defer exitHooksMu.Unlock()
+		for _, fn := range exitHooks {
+			fn()
+		}
+	})
+}
+
+// exit runs the exit hooks and exits with code. It replaces os.Exit once
+// anything needing cleanup may have started.
+func exit(code int) {
+	// after an interrupt kubectl's own exit code doesn't matter
+	if sig := interruptSignal(); sig != nil {
+		code = signalExitCode(sig)
+	}
+	runExitHooks()
+	os.Exit(code)
+}
+
+// fatal logs err and exits with 1 after running the exit hooks
+func fatal(err error) {
+	// after an interrupt the error is only kubectl not starting or stopping
+	if interruptSignal() == nil {
+		logger.Error(err.Error())
 	}
+	exit(1)
 }
 
 func main() {
@@ -34,8 +69,26 @@ func main() {
 		os.Exit(0)
 	}
 
-	_, kDebugBool := os.LookupEnv("K_DEBUG")
-	kubectlBinary, _ = exec.LookPath("kubectl")
+	// kubectl runs k in place of exec credential plugins when credentials
+	// are cached
+	if os.Args[1] == credentialShimCommand {
+		os.Exit(runCredentialShim(os.Args[2:], os.Stdout))
+	}
+	// kept tunnels run under k so they stop themselves when unused
+	if os.Args[1] == tunnelSupervisorCommand {
+		os.Exit(runTunnelSupervisor(os.Args[2:]))
+	}
+
+	// the completion scripts run k __complete for every tab
+	switch os.Args[1] {
+	case completeCommand:
+		exit(runComplete(os.Args[2:], os.Stdout))
+	case "completion":
+		os.Exit(runCompletion(os.Args[2:], os.Stdout))
+	}
+
+	// pass Ctrl-C and friends on to every kubectl and wait for them
+	handleSignals()
 
 	// remove command name
 	var passedArgs []string
@@ -44,45 +97,55 @@ func main() {
 		passedArgs = append(passedArgs, arg)
 	}
 
-	// Handle version command - print k version and kubectl version
-	if len(passedArgs) > 0 && passedArgs[0] == "version" {
-		fmt.Printf("k version: %s\n", version)
-		// Continue to kubectl version below
+	// remove k's own --k-* flags before anything is passed to kubectl
+	var err error
+	kOpts, passedArgs, err = extractKFlags(passedArgs)
+	if err != nil {
+		fatal(err)
 	}
 
-	// check if KUBE_NAMESPACE is set
-	namespace, envSet := os.LookupEnv("KUBE_NAMESPACE")
-	if envSet {
-		// don't use env if flags already specified
-		_, foundNS := sliceFind(passedArgs, "--namespace")
-		_, foundNS2 := sliceFind(passedArgs, "-n")
-		if !foundNS && !foundNS2 {
-			passedArgs = append(passedArgs, "--namespace", namespace)
+	// k can be installed as kubectl-k or even as kubectl, so make sure the
+	// kubectl we run isn't k itself
+	binary, err := findKubectl()
+
+	// Handle version command - print k version and kubectl version
+	if parseKubectlArgs(passedArgs).verb == "version" {
+		fmt.Printf("k version: %s\n", version)
+		if err != nil {
+			// k's version is still useful without kubectl
+			logger.Warn(err.Error())
+			os.Exit(0)
 		}
+		// Continue to kubectl version below
 	}
-	context, envSet := os.LookupEnv("KUBE_CONTEXT")
-	if envSet {
-		_, foundContext := sliceFind(passedArgs, "--context")
-		if !foundContext {
-			passedArgs = append(passedArgs, "--context", context)
-		}
+	if err != nil {
+		fatal(err)
 	}
 
-	// check if KUBECONFIG is NOT set
-	// we don't set the argument if KUBECONFIG is explicitly set
-	_, kubeconfigEnvBool := os.LookupEnv("KUBECONFIG")
-	_, kubeconfigArgBool := sliceFind(passedArgs, "--kubeconfig")
-	if !kubeconfigEnvBool && !kubeconfigArgBool {
-		// if KUBECONFIG isn't set generate one from all the files in ~/.kube
-		// ignore cache and http-cache directories
-		kubeEnv = buildKubeconfig()
-	} else {
-		kubeEnv = os.Getenv("KUBECONFIG")
+	// KUBE_CONTEXT and KUBE_NAMESPACE are only used when neither a flag nor
+	// a kspace sets the context or namespace
+	env := envDefaults{
+		context:   os.Getenv("KUBE_CONTEXT"),
+		namespace: os.Getenv("KUBE_NAMESPACE"),
 	}
-	if kDebugBool {
-		fmt.Printf("[DEBUG] Arguments passed: %s\n", passedArgs)
-		fmt.Printf("[DEBUG] Using KUBECONFIG: %s\n", kubeEnv)
+	parsed := parseKubectlArgs(passedArgs)
+
+	runner := newRunner(binary, parsed)
+	defaultRunner = runner
+	setNamespaceCacheScope(parsed, runner.kubeconfig)
+
+	// send exec credential plugins through k so targets sharing a user
+	// share its credentials. config commands may write to kubeconfig so
+	// they always see the real files.
+	_, cacheCredentialsEnv := os.LookupEnv("K_CACHE_CREDENTIALS")
+	if (kOpts.cacheCredentials || cacheCredentialsEnv) && !parsed.has("kubeconfig") && parsed.verb != "config" {
+		if runner.kubeconfig, err = setupCredentialCache(runner.kubeconfig); err != nil {
+			logger.Warn("not caching credentials", "error", err)
+		}
+		defaultRunner = runner
 	}
+	logger.Debug("arguments passed", "args", passedArgs)
+	logger.Debug("using KUBECONFIG", "kubeconfig", runner.kubeconfig)
 
 	// check if the first arg is special syntax
 	// can specify
@@ -93,179 +156,147 @@ func main() {
 	// user@cluster:namespace
 	// +context
 	// +context:namespace
-	kspacePrefixes := []string{"@", "+", ":"}
-	var kspaces []string
-	var args []string
-	for _, arg := range passedArgs {
-		if hasPrefixAny(arg, kspacePrefixes) {
-			kspaces = append(kspaces, arg)
+	kspaces, args := splitKspaces(passedArgs)
+	for i, kspace := range kspaces {
+		if isIncompleteKspace(kspace) {
+			// a bare + or @ asks the user to pick contexts or clusters
+			kspaces[i], err = completeKspace(kspace)
 		} else {
-			args = append(args, arg)
+			kspaces[i], err = expandKspace(kspace)
+		}
+		if err != nil {
+			fatal(err)
 		}
 	}
-	if len(kspaces) > 0 {
-
-		clustersMap, kSpaceNames := ParseCluster(kspaces)
-		if len(clustersMap) > 1 {
-			// Interactive commands cannot be run against multiple targets
-			if isInteractiveCommand(args) {
-				log.Fatalf("Error: Interactive commands (edit, exec -it, attach, etc.) cannot be run against multiple contexts/clusters/namespaces.\nPlease specify only one target.")
-			}
-
-			// Run commands for multiple targets concurrently
-			var wg sync.WaitGroup
-			for name, cluster := range clustersMap {
-				wg.Add(1)
-				go func(name string, cluster Cluster) {
-					defer wg.Done()
-
-					// Build args for this specific cluster/context/namespace
-					cmdArgs := make([]string, len(args))
-					copy(cmdArgs, args)
-
-					if kDebugBool {
-						fmt.Printf("[DEBUG] Detected multiple args for %s\n", name)
-					}
-
-					if cluster.context != "" {
-						// only add context because it contains other info
-						// parsing doesn't currently support overriding context
-						cmdArgs = append(cmdArgs, "--context", cluster.context)
-					} else {
-						fmt.Fprintf(os.Stderr, "failed to process %+v\n", cluster)
-						return
-					}
-
-					if cluster.namespace != "" {
-						if cluster.namespace == "*" {
-							cmdArgs = append(cmdArgs, "--all-namespaces")
-						} else {
-							cmdArgs = append(cmdArgs, "--namespace", cluster.namespace)
-						}
-					}
-
-					if kDebugBool {
-						fmt.Printf("[DEBUG] Running: kubectl %s\n", strings.Join(cmdArgs, " "))
-					}
-					runKubectl(cmdArgs, name, kubectlBinary)
-				}(name, cluster)
-			}
-			wg.Wait()
-		} else if len(clustersMap) == 1 {
-			// cluster should be of type cluster
-			cluster := clustersMap[kSpaceNames[0]]
-			// fmt.Println(cluster)
-			args := passedArgs[1:]
-			if cluster.context != "" {
-				// only add context because it contains other info
-				// parsing doesn't currently support overriding context
-				args = append(args, "--context", cluster.context)
-			} else {
-				fmt.Fprintf(os.Stderr, "Failed to process %+v\n", cluster)
-				os.Exit(1)
-			}
 
-			if cluster.namespace != "" {
-				if cluster.namespace == "*" {
-					args = append(args, "--all-namespaces")
-				} else {
-					args = append(args, "--namespace", cluster.namespace)
-				}
-			}
+	// kubectl plugins on PATH (kubectl-foo) are run directly with the
+	// kspace flags added, the same way kubectl would run them
+	plugin := ""
+	isPing := parseKubectlArgs(args).verb == "ping"
+	if pluginPath, pluginArgs, ok := findPlugin(args); ok && !isPing {
+		plugin, args = pluginPath, pluginArgs
+		logger.Debug("using plugin", "plugin", pluginPath)
+	}
+	// runnerFor returns a Runner with the kubectl and environment the k
+	// config sets for the target's context, or the plugin when one is run
+	runnerFor := func(target Target) Runner {
+		r, err := runnerForContext(runner, targetContext(args, target, env))
+		if err != nil {
+			// tunnels for other targets may already be up
+			fatal(err)
+		}
+		if plugin != "" {
+			r.binary = plugin
+		}
+		logger.Debug("using kubectl", "kubectl", r.binary, "env", r.env)
+		return r
+	}
 
-			if kDebugBool {
-				fmt.Printf("[DEBUG] Running: kubectl %s\n", strings.Join(args, " "))
+	// k ping checks the API server of every target instead of running kubectl
+	if isPing {
+		clustersMap, kSpaceNames, err := ParseCluster(kspaces)
+		if err != nil {
+			fatal(err)
+		}
+		if err := checkClustersFound(clustersMap); err != nil {
+			fatal(err)
+		}
+		if len(kspaces) == 0 {
+			// label the current context like a kspace
+			current := env.context
+			if kc, err := loadKubeconfig(); err == nil && current == "" {
+				current = kc.CurrentContext
 			}
-			runKubectl(args, "", kubectlBinary)
+			clustersMap, kSpaceNames = map[string]Target{"+" + current: {}}, []string{"+" + current}
 		}
-	} else {
-		if kDebugBool {
-			fmt.Printf("[DEBUG] Running: kubectl %s\n", strings.Join(passedArgs, " "))
+		runners := make(map[string]Runner)
+		for name, target := range clustersMap {
+			runners[name] = runnerFor(target)
 		}
-		runKubectl(passedArgs, "", kubectlBinary)
+		timeout := kOpts.preflight
+		if timeout == 0 {
+			timeout = defaultProbeTimeout
+		}
+		if !printPing(os.Stdout, kSpaceNames, probeTargets(clustersMap, runners, env, timeout, true)) {
+			exit(1)
+		}
+		exit(0)
 	}
-}
 
-// isInteractiveCommand checks if the kubectl command requires TTY access
-func isInteractiveCommand(args []string) bool {
-	if len(args) == 0 {
-		return false
-	}
+	if len(kspaces) > 0 {
 
-	interactiveCommands := []string{
-		"edit",
-		"attach",
-	}
+		clustersMap, kSpaceNames, err := ParseCluster(kspaces)
+		if err != nil {
+			fatal(err)
+		}
 
-	// Check if the first arg is an interactive command
-	for _, cmd := range interactiveCommands {
-		if args[0] == cmd {
-			return true
+		// expand label selectors and globs into namespaces, and check
+		// namespaces exist in each target
+		clustersMap, kSpaceNames, err = resolveNamespaces(clustersMap, args, env, !kOpts.skipNamespaceCheck, namespaceLister(runner))
+		if err != nil {
+			fatal(err)
+		}
+		if err := checkClustersFound(clustersMap); err != nil {
+			fatal(err)
 		}
-	}
 
-	// Check for exec with -it or -ti flags
-	if args[0] == "exec" {
-		for _, arg := range args {
-			if arg == "-it" || arg == "-ti" || arg == "-i" || arg == "-t" {
-				return true
+		if len(clustersMap) > 1 {
+			// Interactive commands cannot be run against multiple targets
+			if isInteractiveCommand(args) {
+				fatal(errors.New("Interactive commands (edit, exec -it, attach, etc.) cannot be run against multiple contexts/clusters/namespaces.\nPlease specify only one target."))
 			}
-		}
-	}
 
-	// Check for run with -it or -ti flags
-	if args[0] == "run" {
-		for _, arg := range args {
-			if arg == "-it" || arg == "-ti" {
-				return true
+			// show which namespace each target really uses in its prefix
+			if kc, err := loadKubeconfig(); err == nil {
+				clustersMap, kSpaceNames = defaultNamespaces(clustersMap, args, env, kc)
 			}
+			exit(runTargets(clustersMap, kSpaceNames, args, env, runnerFor))
+		} else if len(clustersMap) == 1 {
+			target := clustersMap[kSpaceNames[0]]
+			cmdArgs := buildKubectlArgs(args, target, env)
+			logger.Debug("running kubectl", "args", cmdArgs)
+			runKubectl(cmdArgs, "", runnerFor(target))
 		}
+	} else {
+		cmdArgs := buildKubectlArgs(args, Target{}, env)
+		logger.Debug("running kubectl", "args", cmdArgs)
+		runKubectl(cmdArgs, "", runnerFor(Target{}))
 	}
 
+	// clean up, and exit like kubectl was stopped if k was interrupted
+	exit(0)
+}
+
+// isInteractiveCommand checks if the kubectl command requires TTY access
+func isInteractiveCommand(args []string) bool {
+	parsed := parseKubectlArgs(args)
+
+	switch parsed.verb {
+	case "edit", "attach":
+		return true
+	case "exec":
+		// exec needs a TTY with -i or -t
+		return parsed.enabled("stdin") || parsed.enabled("tty")
+	case "run":
+		// run is only interactive with both -i and -t
+		return parsed.enabled("stdin") && parsed.enabled("tty")
+	}
 	return false
 }
 
 // isStreamingCommand checks if the kubectl command streams continuous output
 func isStreamingCommand(args []string) bool {
-	if len(args) == 0 {
-		return false
-	}
-
-	// Check for --watch or -w flags
-	for _, arg := range args {
-		if arg == "--watch" || arg == "-w" {
-			return true
-		}
-	}
-
-	// Check for logs with --follow or -f
-	if args[0] == "logs" {
-		for _, arg := range args {
-			if arg == "--follow" || arg == "-f" {
-				return true
-			}
-		}
-	}
+	parsed := parseKubectlArgs(args)
 
-	// Check for get with --watch-only
-	for _, arg := range args {
-		if arg == "--watch-only" {
-			return true
-		}
+	if parsed.enabled("watch") || parsed.enabled("watch-only") {
+		return true
 	}
-
-	return false
+	return parsed.verb == "logs" && parsed.enabled("follow")
 }
 
-func runKubectl(args []string, kspace string, kubectlBinary string) {
+func runKubectl(args []string, kspace string, r Runner) {
 
-	// Create Cmd with options
-	kCmd := exec.Command(kubectlBinary, args...)
-	// set Env to nil to get Env from parent
-	kCmd.Env = nil
-	kCmd.Env = append(os.Environ(),
-		"KUBECONFIG="+kubeEnv,
-	)
+	kCmd := r.Command(args)
 
 	// For interactive commands, directly attach stdin/stdout/stderr
 	if isInteractiveCommand(args) {
@@ -273,27 +304,32 @@ func runKubectl(args []string, kspace string, kubectlBinary string) {
 		kCmd.Stdout = os.Stdout
 		kCmd.Stderr = os.Stderr
 
-		err := kCmd.Run()
+		err := startChild(kCmd)
+		if err == nil {
+			err = waitChild(kCmd)
+		}
 		if err != nil {
 			if exitError, ok := err.(*exec.ExitError); ok {
-				os.Exit(exitError.ExitCode())
+				exit(exitError.ExitCode())
 			}
 		}
 		return
 	}
 
-	// When no kspace prefix is needed, pipe stdout through colorizer
-	if kspace == "" {
+	// When no kspace prefix is needed, pipe stdout through colorizer.
+	// Streams filtered or timestamped by k flags are still handled below.
+	streaming := isStreamingCommand(args)
+	if kspace == "" && !(streaming && (kOpts.grep != nil || kOpts.timestamps)) {
 		kCmd.Stdin = os.Stdin
 		kCmd.Stderr = os.Stderr
 
 		stdout, err := kCmd.StdoutPipe()
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 
-		if err := kCmd.Start(); err != nil {
-			log.Fatal(err)
+		if err := startChild(kCmd); err != nil {
+			fatal(err)
 		}
 
 		if !colorizeOutput(args, stdout, os.Stdout) {
@@ -301,318 +337,293 @@ func runKubectl(args []string, kspace string, kubectlBinary string) {
 			io.Copy(os.Stdout, stdout)
 		}
 
-		if err := kCmd.Wait(); err != nil {
+		if err := waitChild(kCmd); err != nil {
 			if exitError, ok := err.(*exec.ExitError); ok {
-				os.Exit(exitError.ExitCode())
+				exit(exitError.ExitCode())
 			}
 		}
 		return
 	}
 
-	// For non-interactive commands, use pipes to allow line prefixing
-	fi, _ := os.Stdin.Stat()
-	if (fi.Mode() & os.ModeCharDevice) == 0 {
-		// Check if k was piped to and pass stdin to kubectl
-		kCmd.Stdin = os.Stdin
+	code, _ := runPrefixed(kCmd, kspace, 0)
+	if code != 0 && !streaming {
+		// I'm not positive we should exit. If multiple kubectls are run
+		// should the entire k command show an error?
+		exit(code)
 	}
+}
 
-	stdout, err := kCmd.StdoutPipe()
-	if err != nil {
-		log.Fatal(err)
-	}
-	stderr, err := kCmd.StderrPipe()
-	if err != nil {
-		log.Fatal(err)
+// runTargets runs kubectl with args for every target at once, with each
+// target's output prefixed with its name, and returns the exit code k exits
+// with. runnerFor returns the Runner for a target.
+func runTargets(targets map[string]Target, names []string, args []string, env envDefaults, runnerFor func(Target) Runner) int {
+	setupPrefixes(names)
+
+	// Merge watches into one table instead of interleaving lines
+	if isWatchCommand(args) {
+		watchAgg = newWatchAggregator(os.Stdout, colorEnabled)
+		args = watchArgs(args)
+	}
+
+	// Give every target its own local ports so port-forwards don't
+	// fight over them, and keep them running
+	var portForwardArgs map[string][]string
+	if isPortForwardCommand(args) {
+		var mappings map[string][]portMapping
+		var err error
+		portForwardArgs, mappings, err = portForwardTargets(args, names, kOpts.portTemplate)
+		if err != nil {
+			fatal(err)
+		}
+		printPortMappings(os.Stdout, names, portForwardResource(args), mappings)
 	}
 
-	// For streaming with kspace prefix, use line-by-line reading
-	// This allows prefixing but may have slight buffering
-	if isStreamingCommand(args) {
-		// Use io.Copy with a prefix writer for streaming commands with kspace
-		var wg sync.WaitGroup
-		wg.Add(2)
+	// pick every target's kubectl and environment before anything runs
+	runners := make(map[string]Runner)
+	for name, target := range targets {
+		runners[name] = runnerFor(target)
+	}
 
-		go func() {
-			defer wg.Done()
-			reader := bufio.NewReader(stdout)
-			for {
-				line, err := reader.ReadString('\n')
-				if err != nil {
-					break
-				}
-				if kspace != "" {
-					fmt.Printf("%s\t%s", kspace, line)
-				} else {
-					fmt.Print(line)
+	// skip targets whose API server doesn't answer instead of
+	// waiting for kubectl to time out on them
+	var unreachable []targetResult
+	if kOpts.preflight > 0 {
+		probes := probeTargets(targets, runners, env, kOpts.preflight, false)
+		for _, name := range names {
+			if err := probes[name].err; err != nil {
+				msg := "unreachable: " + err.Error()
+				if kOpts.collect == "" {
+					logger.Warn(msg, "kspace", name)
 				}
+				unreachable = append(unreachable, targetResult{Kspace: name, Context: targets[name].context, Stderr: msg + "\n", ExitCode: 1})
+				delete(runners, name)
 			}
-		}()
+		}
+	}
 
-		go func() {
+	// Run commands for multiple targets concurrently
+	var wg sync.WaitGroup
+	var resultsMu sync.Mutex
+	results := unreachable
+	exitCodes := make(map[string]int)
+	for name, r := range runners {
+		wg.Add(1)
+		go func(name string, target Target, r Runner) {
 			defer wg.Done()
-			reader := bufio.NewReader(stderr)
-			for {
-				line, err := reader.ReadString('\n')
-				if err != nil {
-					break
-				}
-				if kspace != "" {
-					fmt.Printf("%s\t%s", kspace, line)
-				} else {
-					fmt.Print(line)
+
+			// Build args for this specific cluster/context/namespace
+			baseArgs := args
+			if pfArgs, ok := portForwardArgs[name]; ok {
+				baseArgs = pfArgs
+			}
+			cmdArgs := buildKubectlArgs(baseArgs, target, env)
+
+			logger.Debug("running kubectl", "kspace", name, "args", cmdArgs)
+			if portForwardArgs != nil {
+				code := superviseKubectl(cmdArgs, name, r)
+				resultsMu.Lock()
+				exitCodes[name] = code
+				resultsMu.Unlock()
+				return
+			}
+			if kOpts.collect != "" {
+				result := collectKubectl(cmdArgs, name, r)
+				result.Context = target.context
+				result.Namespace = target.namespace
+				if result.Namespace == "" {
+					result.Namespace = target.effectiveNamespace
 				}
+				resultsMu.Lock()
+				results = append(results, result)
+				resultsMu.Unlock()
+				return
 			}
-		}()
-
-		if err := kCmd.Start(); err != nil {
-			log.Fatal(err)
-		}
-
-		wg.Wait()
-		kCmd.Wait()
-		return
+			code := runTarget(cmdArgs, name, r)
+			resultsMu.Lock()
+			exitCodes[name] = code
+			resultsMu.Unlock()
+		}(name, targets[name], r)
 	}
+	wg.Wait()
 
-	// Create a scanner which scans r in a line-by-line fashion
-	stdoutscanner := bufio.NewScanner(stdout)
-	stderrscanner := bufio.NewScanner(stderr)
-
-	// Print STDOUT and STDERR lines streaming from Cmd
-	doneChan := make(chan struct{})
-	go func() {
-		defer close(doneChan)
-		// Read line by line and process it
-		for stdoutscanner.Scan() {
-			line := stdoutscanner.Text()
-			if kspace != "" {
-				fmt.Printf("%s\t%s\n", kspace, line)
-			} else {
-				fmt.Println(line)
-			}
+	if kOpts.collect != "" {
+		if err := renderResults(os.Stdout, results, kOpts.collect); err != nil {
+			fatal(err)
 		}
-		for stderrscanner.Scan() {
-			line := stderrscanner.Text()
-			if kspace != "" {
-				fmt.Printf("%s\t%s\n", kspace, line)
-			} else {
-				fmt.Println(line)
+		// exit with the first failure so scripts can tell something went wrong
+		for _, r := range results {
+			if r.ExitCode != 0 {
+				return r.ExitCode
 			}
 		}
-
-	}()
-	err = kCmd.Run()
-	if err != nil {
-		// stderr is already attached so we don't need to print anything here
-		// I'm not positive we should exit. If multiple kubectls are run
-		// should the entire k command show an error?
-		if exitError, ok := err.(*exec.ExitError); ok {
-			os.Exit(exitError.ExitCode())
+	}
+	// exit with the first failure once every target has finished
+	for _, name := range sortedCopy(names) {
+		if exitCodes[name] != 0 {
+			return exitCodes[name]
 		}
 	}
-}
-
-func captureFirst(r *regexp.Regexp, s string) string {
-	c := r.FindStringSubmatch(s)
-	if len(c) > 1 {
-		return c[1]
+	if len(unreachable) > 0 {
+		return 1
 	}
-	return ""
+	return 0
 }
 
-// ParseCluster is the main function to parse the first argument given to k
-// It attempts to parse the following patterns
-// [@cluster][:namespace][,namespace]
-// [+context][:namespace][,namespace]
-func ParseCluster(kspaces []string) (map[string]Cluster, []string) {
-	kSpace := make(map[string]Cluster)
-
-	var tmpCluster Cluster
-	var tmpName string
-
-	var maybeContext []string
-	var maybeCluster []string
-	var maybeNamespace []string
-
-	for _, s := range kspaces {
-		// I'm sorry. Regex was the easiest way to parse a string
-		maybeContext = strings.Split(captureFirst(regexp.MustCompile(`(?:\+)([0-9A-Za-z_,.\-@]+)`), s), ",") // capture between + and : or $
-		maybeCluster = strings.Split(captureFirst(regexp.MustCompile(`(?:@)([0-9A-Za-z_,.\-@]+)`), s), ",")  // capture between @ and : or $
-		maybeNamespace = strings.Split(captureFirst(regexp.MustCompile(`(?::)(.+)(?:$)`), s), ",")           // capture between : and $
-
-		_, kDebugBool := os.LookupEnv("K_DEBUG")
-		if kDebugBool {
-			fmt.Println("[DEBUG] Parsed context(s): ", strings.Join(maybeContext, " "))
-			fmt.Println("[DEBUG] Parsed namespace(s): ", strings.Join(maybeNamespace, " "))
-			fmt.Println("[DEBUG] Parsed cluster(s): ", strings.Join(maybeCluster, " "))
-		}
-
-		if maybeContext[0] != "" {
-			// check if we have more than 1 namespace
-			if len(maybeNamespace) > 0 && maybeNamespace[0] != "" {
-				for _, ctx := range maybeContext {
-					for _, ns := range maybeNamespace {
-						// run if given 1 or more context and 1 or more namespace
-						tmpName = "+" + ctx + ":" + ns
-						tmpCluster.context = ctx
-						tmpCluster.namespace = ns
-						kSpace[tmpName] = tmpCluster
-					}
-				}
-			} else {
-				// No namespace given
-				for _, ctx := range maybeContext {
-					tmpName = "+" + ctx
-					tmpCluster.context = ctx
-					kSpace[tmpName] = tmpCluster
-				}
-			}
-
-		} else if maybeCluster[0] != "" {
-			if len(maybeNamespace) > 0 && maybeNamespace[0] != "" {
-				for _, cl := range maybeCluster {
-					for _, ns := range maybeNamespace {
-						// run if given 1 or more context and 1 or more namespace
-						tmpName = "@" + cl + ":" + ns
-						tmpCluster.context = getContextFromCluster(cl, kubectlBinary)
-						tmpCluster.cluster = cl
-						tmpCluster.namespace = ns
-						kSpace[tmpName] = tmpCluster
-					}
-				}
-			} else {
-				// No namespace given
-				for _, cl := range maybeCluster {
-					tmpName = "@" + cl
-					tmpCluster.cluster = cl
-					tmpCluster.context = getContextFromCluster(cl, kubectlBinary)
-					kSpace[tmpName] = tmpCluster
-				}
-			}
-		} else if maybeNamespace[0] != "" {
-			for _, ns := range maybeNamespace {
-				tmpName = ":" + ns
-				tmpCluster.namespace = ns
-				kSpace[tmpName] = tmpCluster
-			}
+// runTarget runs kubectl for one target of a multi-target run and returns
+// its exit code. kubectl is killed after --k-timeout and failed commands
+// that only read are retried --k-retries times.
+func runTarget(args []string, kspace string, r Runner) int {
+	return retryKubectl(args, kspace, func() int {
+		code, _ := runPrefixed(r.Command(args), kspace, kOpts.timeout)
+		if code != 0 && isStreamingCommand(args) {
+			// streams end when their target goes away, that's not an error
+			return 0
 		}
-	}
-
-	kNames := make([]string, len(kSpace))
+		return code
+	})
+}
 
-	i := 0
-	for k := range kSpace {
-		kNames[i] = k
-		i++
+// runPrefixed runs kCmd with every line of its output prefixed with kspace.
+// If timeout isn't 0 kubectl is killed when it runs longer. It returns the
+// exit code and whether kubectl timed out.
+func runPrefixed(kCmd *exec.Cmd, kspace string, timeout time.Duration) (int, bool) {
+	// For non-interactive commands, use pipes to allow line prefixing
+	fi, _ := os.Stdin.Stat()
+	if (fi.Mode() & os.ModeCharDevice) == 0 {
+		// Check if k was piped to and pass stdin to kubectl
+		kCmd.Stdin = os.Stdin
 	}
-	return kSpace, kNames
-}
 
-func getContextFromCluster(s string, kubectlBinary string) string {
-	// reads in a cluster string
+	stdout, err := kCmd.StdoutPipe()
+	if err != nil {
+		fatal(err)
+	}
+	stderr, err := kCmd.StderrPipe()
+	if err != nil {
+		fatal(err)
+	}
 
-	var context string
-	template := "{{ range .contexts  }}{{ printf \"%s %s\\n\" .name .context.cluster }}{{ end  }}"
+	// Read stdout and stderr concurrently so lines are printed in the order
+	// they arrive. Each stream keeps its own file descriptor so redirecting
+	// stderr works the same as it does with kubectl.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if watchAgg != nil {
+			watchAgg.copy(stdout, kspace)
+			return
+		}
+		copyPrefixed(os.Stdout, stdout, kspace, kOpts.grep)
+	}()
+	go func() {
+		defer wg.Done()
+		copyPrefixed(os.Stderr, stderr, kspace, nil)
+	}()
 
-	// execute self
-	ctxCmd := exec.Command(kubectlBinary, "config", "view", "--output", "template", "--template", template)
-	ctxCmd.Env = append(os.Environ(),
-		"KUBECONFIG="+kubeEnv,
-	)
-	ctxCmd.Stderr = os.Stderr
+	if err := startChild(kCmd); err != nil {
+		fatal(err)
+	}
+	timer := killAfter(kCmd, timeout)
 
-	// Run and wait for Cmd to return Status
-	ctxOutput, err := ctxCmd.StdoutPipe()
-	if err != nil {
-		log.Fatal(err)
+	// all output has to be read before Wait closes the pipes
+	wg.Wait()
+	err = waitChild(kCmd)
+	if timer.stop() {
+		logger.Warn(fmt.Sprintf("timed out after %s", timeout), "kspace", kspace)
+		return timeoutExitCode, true
 	}
-	if err := ctxCmd.Start(); err != nil {
-		log.Fatal(err)
+	if exitError, ok := err.(*exec.ExitError); ok {
+		return exitError.ExitCode(), false
 	}
+	return 0, false
+}
 
-	_, kDebugBool := os.LookupEnv("K_DEBUG")
+// ParseCluster parses kspaces into targets keyed by their kspace, and
+// returns the kspaces of the targets in order. A @cluster target runs with
+// the first context that uses the cluster, its context is empty when there
+// isn't one.
+func ParseCluster(kspaces []string) (map[string]Target, []string, error) {
+	parsed, err := kspace.ParseAll(kspaces)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	scanner := bufio.NewScanner(ctxOutput)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if kDebugBool {
-			fmt.Printf("[DEBUG] Looking for %s in %s\n", s, strings.Fields(line))
+	targets := make(map[string]Target)
+	var names []string
+	for _, p := range parsed {
+		target := Target{context: p.Context, cluster: p.Cluster, namespace: p.Namespace}
+		if target.cluster != "" {
+			target.context = getContextFromCluster(target.cluster)
 		}
+		targets[p.Name] = target
+		names = append(names, p.Name)
+	}
+	return targets, names, nil
+}
 
-		contextMatch, _ := regexp.MatchString(strings.Fields(line)[1], s)
-		if contextMatch {
-			context = strings.Fields(line)[0]
-			if kDebugBool {
-				fmt.Printf("[DEBUG] Found context: %s\n", context)
-			}
-			break
+// checkClustersFound fails if a @cluster target has no context using the
+// cluster, rather than running it in the current context
+func checkClustersFound(targets map[string]Target) error {
+	for _, name := range sortedCopy(mapKeys(targets)) {
+		if target := targets[name]; target.cluster != "" && target.context == "" {
+			return fmt.Errorf("%s: no context found for cluster %s", name, target.cluster)
 		}
 	}
-	if err := ctxCmd.Wait(); err != nil {
-		log.Fatal(err)
+	return nil
+}
+
+// getContextFromCluster returns the first context in kubeconfig that uses
+// cluster, or an empty string
+func getContextFromCluster(cluster string) string {
+	kc, err := loadKubeconfig()
+	if err != nil {
+		logger.Debug("looking for cluster", "cluster", cluster, "error", err)
+		return ""
+	}
+	lookup := kspace.Kubeconfig{CurrentContext: kc.CurrentContext}
+	for _, c := range kc.Contexts {
+		lookup.Contexts = append(lookup.Contexts, kspace.Context{Name: c.Name, Cluster: c.Context.Cluster, Namespace: c.Context.Namespace})
 	}
+	context, _ := lookup.ContextForCluster(cluster)
+	logger.Debug("found context for cluster", "cluster", cluster, "context", context)
 	return context
 }
 
-/*
-Cluster describes the basic structure for variables we use
-for lookups or arguments to kubectl
-*/
-type Cluster struct {
+// Target is one place a kubectl command runs: a context, a cluster (looked
+// up to find its context) and a namespace. It's what a kspace like
+// +prod:web or @prod expands to.
+type Target struct {
 	cluster   string
 	namespace string
 	context   string
+	// effectiveNamespace is the namespace kubectl uses when namespace
+	// isn't set, it's only used to label output
+	effectiveNamespace string
 }
 
-func buildKubeconfig() (kc string) {
-	var kubeconfig string
-	_, kDebugBool := os.LookupEnv("K_DEBUG")
-
-	// Always put ~/.kube/config first if it exists
-	defaultConfig := os.Getenv("HOME") + "/.kube/config"
-	if _, err := os.Stat(defaultConfig); err == nil {
-		kubeconfig = defaultConfig
-		if kDebugBool {
-			fmt.Printf("Found default config: %s\n", defaultConfig)
-		}
+// newRunner returns a runner for binary. When neither KUBECONFIG nor
+// --kubeconfig is set kubectl gets a KUBECONFIG with every file in ~/.kube.
+func newRunner(binary string, parsed kubectlArgs) kubectlRunner {
+	runner := kubectlRunner{binary: binary}
+	if _, ok := os.LookupEnv("KUBECONFIG"); !ok && !parsed.has("kubeconfig") {
+		runner.kubeconfig = buildKubeconfig()
+	} else {
+		runner.kubeconfig = os.Getenv("KUBECONFIG")
 	}
+	return runner
+}
 
+// buildKubeconfig returns a KUBECONFIG with every kubeconfig file in ~/.kube
+func buildKubeconfig() string {
 	// TODO XDG_HOME
-	err := filepath.Walk(os.Getenv("HOME")+"/.kube", func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			fmt.Printf("prevent panic by handling failure accessing a path %q: %v\n", path, err)
-			return err
-		}
-		if kDebugBool {
-			fmt.Printf("Found: %+v \n", info.Name())
-		}
-		if info.IsDir() && (info.Name() == "cache" ||
-			info.Name() == "http-cache" ||
-			info.Name() == "kubens") {
-			if kDebugBool {
-				fmt.Printf("skipping without errors: %+v \n", info.Name())
-			}
-			return filepath.SkipDir
-		} else {
-			if !info.IsDir() &&
-				info.Name() != "kubectx" &&
-				info.Name() != "config" &&
-				!strings.Contains(info.Name(), ".lock") {
-				if path != "" {
-					if len(kubeconfig) == 0 {
-						kubeconfig = path
-					} else {
-						kubeconfig = kubeconfig + ":" + path
-					}
-				}
-			}
-		}
-		return nil
-	})
+	files, err := kspace.KubeconfigFiles(filepath.Join(os.Getenv("HOME"), ".kube"))
 	if err != nil {
-		fmt.Printf("error walking the path")
-		return
+		logger.Warn("finding kubeconfig files", "error", err)
+		return ""
 	}
-	return strings.TrimSuffix(kubeconfig, ":")
+	logger.Debug("found kubeconfig files", "files", files)
+	return strings.Join(files, string(filepath.ListSeparator))
 }
 
 // sliceFind takes a slice and looks for an element in it. If found it will
@@ -626,13 +637,12 @@ func sliceFind(slice []string, val string) (int, bool) {
 	return -1, false
 }
 
-func hasPrefixAny(s string, pslice []string) bool {
-	for _, prefix := range pslice {
-		if strings.HasPrefix(s, prefix) {
-			return true
-		}
-	}
-	return false
+// sortedCopy returns a sorted copy of slice
+func sortedCopy(slice []string) []string {
+	sorted := make([]string, len(slice))
+	copy(sorted, slice)
+	sort.Strings(sorted)
+	return sorted
 }
 
 func usage() {
@@ -640,6 +650,8 @@ func usage() {
 
 Usage:
 	k ( @cluster... | +context... )[:namespace[,namespace]] <kubectl options>
+	k ( @cluster... | +context... ):{label-selector} <kubectl options>
+	k +[tag-selector][:namespace] <kubectl options>
 	k <kubectl options>
 
 k is a wrapper for kubectl that makes using multiple clusters, namespaces,
@@ -666,12 +678,97 @@ Examples:
 	Runs: kubectl --namespace default get svc
 	      kubectl --namespace kube-system get svc
 
+	k '+prod:team-*' get pods
+	# namespaces are checked against each target and globs are expanded
+	Runs: kubectl --context prod --namespace team-a get pods
+	      kubectl --context prod --namespace team-b get pods
+
+	k '+prod,stage:{team=payments}' get pods
+	# namespaces with matching labels are selected in each target
+
+	k '+[env=prod,region=eu]' get nodes
+	# contexts are selected by tags from the k config file or the "k"
+	# extension of the context in kubeconfig
+
+	k '+prod-*' get pods
+	# context names can be globs too
+
+	k ping '+*'
+	# checks every context's API server and prints its latency and version
+
+	k + get pods
+	# a bare + or @ opens a picker to choose one or more contexts or
+	# clusters (tab selects, typing filters)
+
+	k +prod +stage neat get pod web -o yaml
+	# kubectl plugins on PATH (kubectl-neat) get the same flags
+	Runs: kubectl-neat get pod web -o yaml --context prod
+	      kubectl-neat get pod web -o yaml --context stage
+
+	kubectl k +prod get pods
+	# k also works as a kubectl plugin when installed as kubectl-k
+
+	source <(k completion bash)
+	# completes kspaces and kubectl arguments (also zsh, fish and
+	# powershell)
+
+k Flags:
+	k's own flags start with --k- and are never passed to kubectl.
+
+	--k-grep <regex>   only print output lines matching regex when output
+	                   from multiple targets (or a stream) is prefixed.
+	                   Errors are always printed
+	--k-timestamps     prefix streamed lines with the time they arrived
+	--k-collect[=json] capture the output and exit code of every target and
+	                   print a table of results (or JSON) showing which
+	                   targets returned the same output
+	--k-skip-ns-check  don't check :namespace against the namespaces that
+	                   exist in each target (globs like :team-* are then
+	                   passed to kubectl as is)
+	--k-port-template  local port for multi-target port-forward where
+	                   {idx} is the target number (from 0) and {port}
+	                   the requested port, e.g. 30{idx} or {port}{idx}
+	--k-timeout <d>    kill a target's kubectl after this long (e.g. 30s)
+	                   and report it as timed out (exit code 124)
+	--k-retries <n>    retry failed get, describe, top and other read-only
+	                   commands n times per target with backoff
+	--k-preflight[=5s] check every target's API server answers /readyz
+	                   within the timeout first and skip the ones that
+	                   don't
+	--k-cache-credentials
+	                   run exec credential plugins (aws, gke-gcloud-auth-
+	                   plugin, kubelogin...) once per user and share the
+	                   credential until it expires
+
+	k +us-east-1 +us-west-2 logs -f deploy/api --k-grep error
+	Each target's lines are prefixed with its own color and aligned.
+
+	k +us-east-1 +us-west-2 get pods -w
+	Watches are merged into one table that updates in place.
+
+	k +us-east-1 +us-west-2 port-forward svc/grafana 3000
+	Each target gets its own local port (3000, 3001) and is reconnected
+	when the forward drops, unless it never came up. Use
+	--k-port-template to choose the ports.
+
 Environment Variables:
-	Setting the flags manually will override the environment variable.
+	Setting the flags manually will override a kspace and the environment
+	variable, and a kspace overrides the environment variable.
 	e.g. KUBE_NAMESPACE=kube-system k get pod -n default
 	  This example will get pods in the default namespace.
-
-	K_DEBUG:        troubleshoot k wrapper
+	e.g. KUBE_NAMESPACE=kube-system k +prod:web get pod
+	  This example will get pods in the web namespace.
+
+	K_LOG_LEVEL:    debug, info (default), warn or error for k's own
+	                messages, which always go to stderr
+	K_LOG_FORMAT:   json prints k's messages as JSON lines
+	K_CONFIG:       path to the k config file
+	                (default $XDG_CONFIG_HOME/k/config.yaml)
+	K_CACHE_CREDENTIALS: always cache exec credentials
+	K_KUBECTL:      kubectl binary to run (default kubectl on PATH).
+	                Contexts can use their own kubectl with "kubectl:",
+	                environment variables with "env:" and a proxy or
+	                tunnel with "tunnel:" in the k config file
 	KUBE_NAMESPACE: sets the --namespace argument
 	KUBE_CONTEXT:   sets the --context argument
 
@@ -689,11 +786,19 @@ Environment Variables:
 	WARNING: This CLI is likely to change. Please do not rely on it
 	for automation or in scripts.
 
+	Arguments after -- are never treated as kspaces, e.g.
+	k +prod exec pod -- grep :8080 /etc/config
+
 	WARNING 2: Argument parsing will have unpredictable behavior if
 	your contexts or clusters have a colon in their name.
 
 	To print kubectl help use k help
 `
+	if isPluginInvocation() {
+		// show commands the way they're typed when k runs as kubectl-k
+		usage = strings.ReplaceAll(usage, "\tk ", "\tkubectl k ")
+		usage = strings.ReplaceAll(usage, "use k help", "use kubectl k help")
+	}
 	fmt.Printf("%s", usage)
 	fmt.Printf("\tk version: \t%s\n", version)
 }
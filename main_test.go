@@ -1,9 +1,32 @@
 package main
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	goocolor "github.com/gookit/color"
+	"gopkg.in/yaml.v3"
+)
 
 func TestParseClusterSingleContext(t *testing.T) {
-	cluster, names := ParseCluster([]string{"+prod"})
+	cluster, names, err := ParseCluster([]string{"+prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	if names[0] != "+prod" {
 		t.Errorf("kSpace Name incorrect: got %s, want +prod", names[0])
@@ -15,7 +38,10 @@ func TestParseClusterSingleContext(t *testing.T) {
 }
 
 func TestParseClusterMultipleContexts(t *testing.T) {
-	cluster, names := ParseCluster([]string{"+prod", "+stage"})
+	cluster, names, err := ParseCluster([]string{"+prod", "+stage"})
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	if len(names) != 2 {
 		t.Errorf("Incorrect names length: got %d, want 2", len(names))
@@ -31,7 +57,10 @@ func TestParseClusterMultipleContexts(t *testing.T) {
 }
 
 func TestParseClusterMultipleContextsWithNamespaces(t *testing.T) {
-	cluster, names := ParseCluster([]string{"+prod:default,frontend", "+stage:default,kube-system"})
+	cluster, names, err := ParseCluster([]string{"+prod:default,frontend", "+stage:default,kube-system"})
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	if len(names) != 4 {
 		t.Errorf("Incorrect names length: got %d, want 4", len(names))
@@ -63,6 +92,11 @@ func TestIsStreamingCommand(t *testing.T) {
 		{"get without watch", []string{"get", "pods"}, false},
 		{"apply command", []string{"apply", "-f", "file.yaml"}, false},
 		{"describe command", []string{"describe", "pod", "foo"}, false},
+		{"get with --watch=true", []string{"get", "pods", "--watch=true"}, true},
+		{"get with --watch=false", []string{"get", "pods", "--watch=false"}, false},
+		{"logs with grouped -pf", []string{"logs", "-pf", "pod-name"}, true},
+		{"apply with -f", []string{"apply", "-f", "file.yaml"}, false},
+		{"exec with -w after --", []string{"exec", "pod", "--", "watch", "-w"}, false},
 		{"empty args", []string{}, false},
 	}
 
@@ -97,6 +131,10 @@ func TestIsInteractiveCommand(t *testing.T) {
 		{"delete command", []string{"delete", "pod", "foo"}, false},
 		{"logs command", []string{"logs", "pod-name"}, false},
 		{"describe command", []string{"describe", "pod", "foo"}, false},
+		{"exec with --stdin --tty", []string{"exec", "--stdin", "--tty", "pod-name", "--", "bash"}, true},
+		{"exec with -i after --", []string{"exec", "pod-name", "--", "bash", "-i"}, false},
+		{"exec with namespace first", []string{"-n", "default", "exec", "-it", "pod-name"}, true},
+		{"run with -i -t", []string{"run", "-i", "-t", "test", "--image=nginx"}, true},
 		{"empty args", []string{}, false},
 	}
 
@@ -199,45 +237,1910 @@ func TestSliceFind(t *testing.T) {
 	}
 }
 
-func TestHasPrefixAny(t *testing.T) {
+func TestParseClusterMultipleNamespaces(t *testing.T) {
+	// Test that multiple namespaces are properly expanded for streaming commands
+	cluster, names, err := ParseCluster([]string{":default,kube-system"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(names) != 2 {
+		t.Errorf("Incorrect names length: got %d, want 2", len(names))
+	}
+
+	if cluster[":default"].namespace != "default" {
+		t.Errorf("Namespace incorrect: got %s, want default", cluster[":default"].namespace)
+	}
+
+	if cluster[":kube-system"].namespace != "kube-system" {
+		t.Errorf("Namespace incorrect: got %s, want kube-system", cluster[":kube-system"].namespace)
+	}
+}
+
+func TestExtractKFlags(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		wantArgs   []string
+		wantGrep   string
+		wantStamps bool
+		wantErr    bool
+	}{
+		{"no k flags", []string{"get", "pods"}, []string{"get", "pods"}, "", false, false},
+		{"grep with space", []string{"logs", "-f", "--k-grep", "err", "pod"}, []string{"logs", "-f", "pod"}, "err", false, false},
+		{"grep with equals", []string{"logs", "--k-grep=err|warn", "pod"}, []string{"logs", "pod"}, "err|warn", false, false},
+		{"timestamps", []string{"logs", "--k-timestamps", "pod"}, []string{"logs", "pod"}, "", true, false},
+		{"timestamps false", []string{"logs", "--k-timestamps=false", "pod"}, []string{"logs", "pod"}, "", false, false},
+		{"after double dash", []string{"exec", "pod", "--", "echo", "--k-grep"}, []string{"exec", "pod", "--", "echo", "--k-grep"}, "", false, false},
+		{"missing value", []string{"logs", "--k-grep"}, nil, "", false, true},
+		{"bad regex", []string{"logs", "--k-grep", "("}, nil, "", false, true},
+		{"unknown flag", []string{"get", "--k-nope"}, nil, "", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, args, err := extractKFlags(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("extractKFlags(%v) error = %v, wantErr %v", tt.args, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if strings.Join(args, " ") != strings.Join(tt.wantArgs, " ") {
+				t.Errorf("args = %v, want %v", args, tt.wantArgs)
+			}
+			gotGrep := ""
+			if opts.grep != nil {
+				gotGrep = opts.grep.String()
+			}
+			if gotGrep != tt.wantGrep {
+				t.Errorf("grep = %q, want %q", gotGrep, tt.wantGrep)
+			}
+			if opts.timestamps != tt.wantStamps {
+				t.Errorf("timestamps = %v, want %v", opts.timestamps, tt.wantStamps)
+			}
+		})
+	}
+}
+
+func TestWritePrefixedLine(t *testing.T) {
+	setupPrefixes([]string{"+prod", "+us-west-2"})
+	defer func() {
+		prefixWidth = 0
+		prefixColors = map[string]goocolor.Color{}
+		kOpts = kOptions{}
+	}()
+
+	var buf bytes.Buffer
+	writePrefixedLine(&buf, "+prod", "line one\n")
+	writePrefixedLine(&buf, "+us-west-2", "line two")
+
+	want := "+prod       line one\n+us-west-2  line two\n"
+	if buf.String() != want {
+		t.Errorf("aligned output = %q, want %q", buf.String(), want)
+	}
+
+	buf.Reset()
+	copyPrefixed(&buf, strings.NewReader("all good\nan error\n"), "+prod", regexp.MustCompile("error"))
+	if buf.String() != "+prod       an error\n" {
+		t.Errorf("filtered output = %q", buf.String())
+	}
+
+	// k's own messages are never filtered
+	kOpts.grep = regexp.MustCompile("error")
+	buf.Reset()
+	newLogger(&buf, "", slog.LevelInfo).Warn("timed out after 1s", "kspace", "+prod")
+	if buf.String() != "+prod       Warning: timed out after 1s\n" {
+		t.Errorf("status line = %q", buf.String())
+	}
+
+	if prefixColors["+prod"] == prefixColors["+us-west-2"] {
+		t.Errorf("targets share a color: %v", prefixColors["+prod"])
+	}
+}
+
+func TestCopyPrefixedLongLine(t *testing.T) {
+	// bufio.Scanner stops at 64KiB, make sure long lines make it through whole
+	long := strings.Repeat("x", 200*1024)
+	input := long + "\nshort\nno newline"
+
+	var buf bytes.Buffer
+	copyPrefixed(&buf, strings.NewReader(input), "", nil)
+
+	want := long + "\nshort\nno newline\n"
+	if buf.String() != want {
+		t.Errorf("copyPrefixed output length = %d, want %d", buf.Len(), len(want))
+	}
+}
+
+func TestIsWatchCommand(t *testing.T) {
 	tests := []struct {
 		name     string
-		s        string
-		prefixes []string
+		args     []string
 		expected bool
 	}{
-		{"has prefix @", "@cluster", []string{"@", "+", ":"}, true},
-		{"has prefix +", "+context", []string{"@", "+", ":"}, true},
-		{"has prefix :", ":namespace", []string{"@", "+", ":"}, true},
-		{"no prefix", "get", []string{"@", "+", ":"}, false},
-		{"empty string", "", []string{"@", "+", ":"}, false},
-		{"empty prefixes", "@cluster", []string{}, false},
+		{"get with -w", []string{"get", "pods", "-w"}, true},
+		{"get with --watch-only", []string{"get", "pods", "--watch-only"}, true},
+		{"get wide", []string{"get", "pods", "-w", "-o", "wide"}, true},
+		{"get json", []string{"get", "pods", "-w", "-o", "json"}, false},
+		{"get yaml equals", []string{"get", "pods", "-w", "--output=yaml"}, false},
+		{"get name short", []string{"get", "pods", "-w", "-oname"}, false},
+		{"get without watch", []string{"get", "pods"}, false},
+		{"logs follow", []string{"logs", "-f", "pod"}, false},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := hasPrefixAny(tt.s, tt.prefixes)
+			result := isWatchCommand(tt.args)
 			if result != tt.expected {
-				t.Errorf("hasPrefixAny(%s, %v) = %v, want %v",
-					tt.s, tt.prefixes, result, tt.expected)
+				t.Errorf("isWatchCommand(%v) = %v, want %v", tt.args, result, tt.expected)
 			}
 		})
 	}
 }
 
-func TestParseClusterMultipleNamespaces(t *testing.T) {
-	// Test that multiple namespaces are properly expanded for streaming commands
-	cluster, names := ParseCluster([]string{":default,kube-system"})
+func TestWatchAggregatorEvents(t *testing.T) {
+	var buf bytes.Buffer
+	agg := newWatchAggregator(&buf, false)
 
-	if len(names) != 2 {
-		t.Errorf("Incorrect names length: got %d, want 2", len(names))
+	agg.handleLine("+a", "EVENT    NAME    READY   STATUS    RESTARTS     AGE\n")
+	agg.handleLine("+b", "EVENT    NAME    READY   STATUS    RESTARTS     AGE\n")
+	agg.handleLine("+a", "ADDED    web-1   1/1     Running   1 (2d ago)   3d\n")
+	agg.handleLine("+b", "ADDED    web-1   0/1     Pending   0            1s\n")
+	agg.handleLine("+b", "MODIFIED   web-1   1/1     Running   0            5s\n")
+	agg.handleLine("+a", "DELETED  web-1   1/1     Running   1 (2d ago)   3d\n")
+
+	if len(agg.rows) != 1 {
+		t.Fatalf("rows = %d, want 1", len(agg.rows))
+	}
+	row := agg.rows["+b/web-1"]
+	if row.columns[2] != "Running" {
+		t.Errorf("+b/web-1 status = %s, want Running", row.columns[2])
 	}
 
-	if cluster[":default"].namespace != "default" {
-		t.Errorf("Namespace incorrect: got %s, want default", cluster[":default"].namespace)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("got %d lines, want 5:\n%s", len(lines), buf.String())
+	}
+	if !strings.HasPrefix(lines[0], "EVENT") || !strings.HasPrefix(lines[4], "DELETED  +a") {
+		t.Errorf("unexpected event output:\n%s", buf.String())
+	}
+	if !strings.Contains(lines[1], "1 (2d ago)") {
+		t.Errorf("column with spaces was split: %s", lines[1])
 	}
+}
 
-	if cluster[":kube-system"].namespace != "kube-system" {
-		t.Errorf("Namespace incorrect: got %s, want kube-system", cluster[":kube-system"].namespace)
+func TestPortForwardTargetsTemplate(t *testing.T) {
+	args := []string{"port-forward", "svc/grafana", "3000", "--address", "0.0.0.0", "808:90", ":80"}
+	targetArgs, mappings, err := portForwardTargets(args, []string{"+b", "+a"}, "{port}{idx}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"+a": "port-forward svc/grafana 30000:3000 --address 0.0.0.0 8080:90 :80",
+		"+b": "port-forward svc/grafana 30001:3000 --address 0.0.0.0 8081:90 :80",
+	}
+	for name, w := range want {
+		if got := strings.Join(targetArgs[name], " "); got != w {
+			t.Errorf("args for %s = %q, want %q", name, got, w)
+		}
+	}
+	if len(mappings["+a"]) != 3 || mappings["+a"][2].local != 0 {
+		t.Errorf("mappings for +a = %+v", mappings["+a"])
+	}
+}
+
+func TestPortForwardTargetsSkipsUsedPorts(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("can't listen on localhost:", err)
+	}
+	defer l.Close()
+	busy := l.Addr().(*net.TCPAddr).Port
+
+	args := []string{"port-forward", "svc/grafana", strconv.Itoa(busy)}
+	targetArgs, _, err := portForwardTargets(args, []string{"+a", "+b"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := targetArgs["+a"][2], targetArgs["+b"][2]
+	if a == b {
+		t.Errorf("targets share local port %s", a)
+	}
+	if strings.HasPrefix(a, strconv.Itoa(busy)+":") {
+		t.Errorf("+a was given busy port %d", busy)
+	}
+}
+
+func TestRenderResultsSummary(t *testing.T) {
+	results := []targetResult{
+		{Kspace: "+us-1", Stdout: "a=1\n"},
+		{Kspace: "+eu-2", Stdout: "a=2\n"},
+		{Kspace: "+eu-1", Stdout: "a=1\n"},
+		{Kspace: "+us-2", Stderr: "error: not found\n", ExitCode: 1},
+	}
+
+	var buf bytes.Buffer
+	if err := renderResults(&buf, results, "table"); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, "same on 2/4 targets, differs on +eu-2 +us-2") {
+		t.Errorf("missing summary:\n%s", out)
+	}
+	if !strings.Contains(out, "#1 (+eu-1 +us-1)\na=1\n") {
+		t.Errorf("missing grouped output:\n%s", out)
+	}
+
+	buf.Reset()
+	if err := renderResults(&buf, results, "json"); err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		Results   []targetResult `json:"results"`
+		Identical bool           `json:"identical"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("invalid json: %v\n%s", err, buf.String())
+	}
+	if decoded.Identical || len(decoded.Results) != 4 || decoded.Results[3].ExitCode != 1 {
+		t.Errorf("unexpected json results: %+v", decoded)
+	}
+}
+
+func TestFuzzyMatch(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		s        string
+		expected bool
+	}{
+		{"", "prod", true},
+		{"prd", "prod", true},
+		{"PrD", "prod", true},
+		{"euw", "arn:aws:eks:eu-west-1:cluster/prod", true},
+		{"dorp", "prod", false},
+		{"prodx", "prod", false},
+	}
+
+	for _, tt := range tests {
+		if got := fuzzyMatch(tt.pattern, tt.s); got != tt.expected {
+			t.Errorf("fuzzyMatch(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.expected)
+		}
+	}
+}
+
+func TestPickerKeys(t *testing.T) {
+	p := newPicker("+context", []string{"dev", "prod-eu", "prod-us", "stage"})
+
+	// filter down to the prod contexts and select both
+	for _, key := range []string{"p", "r", "d", "\t", "\x1b[B", " "} {
+		p.handleKey(key)
+	}
+	if got := strings.Join(p.visible(), " "); got != "prod-eu prod-us" {
+		t.Errorf("visible = %q, want prod-eu prod-us", got)
+	}
+	p.handleKey("\r")
+	if !p.done || p.canceled {
+		t.Fatalf("picker should be done: %+v", p)
+	}
+	if got := strings.Join(p.result(), ","); got != "prod-eu,prod-us" {
+		t.Errorf("result = %q, want prod-eu,prod-us", got)
+	}
+
+	// enter without a selection picks the entry under the cursor
+	p = newPicker("@cluster", []string{"a", "b"})
+	p.handleKey("\x1b[B")
+	p.handleKey("\r")
+	if got := strings.Join(p.result(), ","); got != "b" {
+		t.Errorf("result = %q, want b", got)
+	}
+
+	p = newPicker("@cluster", []string{"a", "b"})
+	p.handleKey("\x1b")
+	if !p.canceled {
+		t.Error("escape should cancel the picker")
+	}
+}
+
+func TestIsIncompleteKspace(t *testing.T) {
+	tests := []struct {
+		kspace   string
+		expected bool
+	}{
+		{"+", true},
+		{"@", true},
+		{"+:kube-system", true},
+		{"+prod", false},
+		{"@prod:default", false},
+		{":default", false},
+	}
+
+	for _, tt := range tests {
+		if got := isIncompleteKspace(tt.kspace); got != tt.expected {
+			t.Errorf("isIncompleteKspace(%q) = %v, want %v", tt.kspace, got, tt.expected)
+		}
+	}
+}
+
+func TestResolveNamespaces(t *testing.T) {
+	list := func(context string, selector string, fresh bool) ([]string, error) {
+		switch context {
+		case "prod":
+			return []string{"default", "payments", "team-a", "team-b"}, nil
+		case "stage":
+			return []string{"default", "team-a", "team-c"}, nil
+		}
+		return nil, errors.New("forbidden")
+	}
+
+	clusters := map[string]Target{
+		"+prod:team-*":  {context: "prod", namespace: "team-*"},
+		"+stage:team-*": {context: "stage", namespace: "team-*"},
+		"+prod:default": {context: "prod", namespace: "default"},
+		"+prod:*":       {context: "prod", namespace: "*"},
+		"+locked:foo":   {context: "locked", namespace: "foo"},
+	}
+	resolved, names, err := resolveNamespaces(clusters, nil, envDefaults{}, true, list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "+locked:foo +prod:* +prod:default +prod:team-a +prod:team-b +stage:team-a +stage:team-c"
+	if got := strings.Join(names, " "); got != want {
+		t.Errorf("names = %q, want %q", got, want)
+	}
+	if resolved["+stage:team-c"].namespace != "team-c" || resolved["+stage:team-c"].context != "stage" {
+		t.Errorf("expanded target incorrect: %+v", resolved["+stage:team-c"])
+	}
+
+	_, _, err = resolveNamespaces(map[string]Target{
+		"+prod:paymnts": {context: "prod", namespace: "paymnts"},
+	}, nil, envDefaults{}, true, list)
+	if err == nil || !strings.Contains(err.Error(), `did you mean payments?`) {
+		t.Errorf("expected suggestion for misspelled namespace, got %v", err)
+	}
+
+	_, _, err = resolveNamespaces(map[string]Target{
+		"+stage:team-b*": {context: "stage", namespace: "team-b*"},
+	}, nil, envDefaults{}, true, list)
+	if err == nil || !strings.Contains(err.Error(), "no namespaces match") {
+		t.Errorf("expected error for glob without matches, got %v", err)
+	}
+}
+
+func TestResolveNamespacesTargetContext(t *testing.T) {
+	list := func(context string, selector string, fresh bool) ([]string, error) {
+		if context == "prod" {
+			return []string{"default", "web"}, nil
+		}
+		return []string{"default"}, nil
+	}
+	clusters := map[string]Target{":web": {namespace: "web"}}
+
+	tests := []struct {
+		name string
+		args []string
+		env  envDefaults
+	}{
+		{"KUBE_CONTEXT", []string{"get", "pods"}, envDefaults{context: "prod"}},
+		{"--context", []string{"--context", "prod", "get", "pods"}, envDefaults{}},
+		{"--context over KUBE_CONTEXT", []string{"--context", "prod", "get", "pods"}, envDefaults{context: "stage"}},
+	}
+	for _, tt := range tests {
+		if _, _, err := resolveNamespaces(clusters, tt.args, tt.env, true, list); err != nil {
+			t.Errorf("%s: resolveNamespaces(:web) = %v, want web found in prod", tt.name, err)
+		}
+	}
+}
+
+func TestNamespaceListerUsesContextEnv(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	kc := kubeconfig{CurrentContext: "gke"}
+	for _, name := range []string{"eks", "gke"} {
+		kc.Contexts = append(kc.Contexts, namedContext{Name: name})
+	}
+	useConfigs(t, &kc, &kConfig{Contexts: []contextRule{{Name: "eks", Env: map[string]string{"AWS_PROFILE": "prod"}}}})
+	runner := fakeKubectl(t, `[ "$AWS_PROFILE" = prod ] || { echo "no credentials" >&2; exit 1; }
+echo namespace/default namespace/web
+`)
+
+	namespaces, err := namespaceLister(runner)("eks", "", false)
+	if err != nil || strings.Join(namespaces, " ") != "default web" {
+		t.Errorf("listing namespaces in eks = %q, %v, want them listed with AWS_PROFILE", namespaces, err)
+	}
+	if _, err := namespaceLister(runner)("gke", "", false); err == nil {
+		t.Error("listing namespaces in gke should not get eks's AWS_PROFILE")
+	}
+}
+
+func TestNamespaceListerUsesTunnel(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	useConfigs(t, &kubeconfig{Contexts: []namedContext{{Name: "private"}}}, &kConfig{Contexts: []contextRule{
+		{Name: "private", Tunnel: &tunnelConfig{Proxy: "http://bastion:3128"}},
+	}})
+	runner := fakeKubectl(t, `[ "$HTTPS_PROXY" = http://bastion:3128 ] || exit 1
+echo namespace/web
+`)
+	if namespaces, err := namespaceLister(runner)("private", "", false); err != nil || len(namespaces) != 1 {
+		t.Errorf("listing namespaces behind a tunnel = %q, %v, want them listed through the proxy", namespaces, err)
+	}
+}
+
+func TestNamespaceCacheScope(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	defer func() { namespaceCacheScope = "" }()
+	kind := fakeKubectl(t, "echo namespace/from-kind\n")
+	other := fakeKubectl(t, "echo namespace/from-other\n")
+
+	setNamespaceCacheScope(parseKubectlArgs(nil), "/home/me/.kube/kind")
+	if got, _ := listNamespaces(kind, "kind-kind", "", false); strings.Join(got, " ") != "from-kind" {
+		t.Fatalf("listNamespaces() = %q", got)
+	}
+	// the same context name in another kubeconfig isn't read from the cache
+	setNamespaceCacheScope(parseKubectlArgs([]string{"--kubeconfig", "/tmp/other"}), "/home/me/.kube/kind")
+	if got, _ := listNamespaces(other, "kind-kind", "", false); strings.Join(got, " ") != "from-other" {
+		t.Errorf("listNamespaces() with another kubeconfig = %q, want from-other", got)
+	}
+	// but it is for the same kubeconfig
+	setNamespaceCacheScope(parseKubectlArgs(nil), "/home/me/.kube/kind")
+	if got, _ := listNamespaces(other, "kind-kind", "", false); strings.Join(got, " ") != "from-kind" {
+		t.Errorf("listNamespaces() again = %q, want the cached from-kind", got)
+	}
+}
+
+func TestResolveNamespacesRelistsStaleCache(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	defer func(since time.Time) { namespaceCacheSince = since }(namespaceCacheSince)
+	dir := t.TempDir()
+	listed := filepath.Join(dir, "namespaces")
+	os.WriteFile(listed, []byte("namespace/default namespace/team-a\n"), 0o644)
+	calls := filepath.Join(dir, "calls")
+	runner := fakeKubectl(t, "echo x >> "+calls+"\ncat "+listed+"\n")
+	useConfigs(t, &kubeconfig{Contexts: []namedContext{{Name: "prod"}}}, &kConfig{})
+	list := namespaceLister(runner)
+
+	// an earlier run cached the namespaces, then billing and team-b were created
+	if _, _, err := resolveNamespaces(map[string]Target{"+prod:default": {context: "prod", namespace: "default"}}, nil, envDefaults{}, true, list); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(listed, []byte("namespace/default namespace/team-a namespace/team-b namespace/billing\n"), 0o644)
+	namespaceCacheSince = time.Now()
+
+	clusters := map[string]Target{
+		"+prod:billing":  {context: "prod", namespace: "billing"},
+		"+prod:team-b*":  {context: "prod", namespace: "team-b*"},
+		"+prod:team-a":   {context: "prod", namespace: "team-a"},
+		"+prod:billling": {context: "prod", namespace: "billling"},
+	}
+	_, _, err := resolveNamespaces(clusters, nil, envDefaults{}, true, list)
+	if err == nil || strings.Count(err.Error(), "\n") != 0 || !strings.Contains(err.Error(), `namespace "billling" not found, did you mean billing?`) {
+		t.Errorf("resolveNamespaces() = %v, want only billling not found", err)
+	}
+	delete(clusters, "+prod:billling")
+	_, names, err := resolveNamespaces(clusters, nil, envDefaults{}, true, list)
+	if err != nil || strings.Join(names, " ") != "+prod:billing +prod:team-a +prod:team-b" {
+		t.Errorf("resolveNamespaces() = %q, %v, want the new namespaces found", names, err)
+	}
+	// the cache is listed again once, not for every miss
+	data, _ := os.ReadFile(calls)
+	if n := strings.Count(string(data), "x"); n != 2 {
+		t.Errorf("kubectl listed namespaces %d times, want 2", n)
+	}
+}
+
+func TestResolveNamespacesLabelSelector(t *testing.T) {
+	list := func(context string, selector string, fresh bool) ([]string, error) {
+		if selector != "team=payments,tier!=batch" {
+			t.Errorf("unexpected selector %q", selector)
+		}
+		if context == "prod" {
+			return []string{"payments"}, nil
+		}
+		return []string{"pay-api", "pay-worker"}, nil
+	}
+
+	clusters, _, err := ParseCluster([]string{"+prod,stage:{team=payments,tier!=batch}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// selectors are expanded even when validation is off
+	resolved, names, err := resolveNamespaces(clusters, nil, envDefaults{}, false, list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "+prod:payments +stage:pay-api +stage:pay-worker"
+	if got := strings.Join(names, " "); got != want {
+		t.Errorf("names = %q, want %q", got, want)
+	}
+	if resolved["+stage:pay-api"].context != "stage" {
+		t.Errorf("expanded target incorrect: %+v", resolved["+stage:pay-api"])
+	}
+}
+
+func TestExpandTagKspace(t *testing.T) {
+	var kc kubeconfig
+	err := json.Unmarshal([]byte(`{"contexts": [
+		{"name": "eks-prod-eu", "context": {"cluster": "a"}},
+		{"name": "gke_prod_us", "context": {"cluster": "b", "extensions": [
+			{"name": "k", "extension": {"tags": {"env": "prod", "region": "us"}}}
+		]}},
+		{"name": "aks-dev-eu", "context": {"cluster": "c", "extensions": [
+			{"name": "k", "extension": {"env": "dev", "region": "eu"}}
+		]}}
+	]}`), &kc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cfg kConfig
+	err = yaml.Unmarshal([]byte(`
+contexts:
+- name: "eks-*"
+  tags:
+    provider: eks
+- name: eks-prod-eu
+  tags:
+    env: prod
+    region: eu
+`), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		kspace  string
+		want    string
+		wantErr bool
+	}{
+		{"+[env=prod]", "+eks-prod-eu,gke_prod_us", false},
+		{"+[env=prod,region=eu]:kube-system", "+eks-prod-eu:kube-system", false},
+		{"+[region=eu,env!=prod]", "+aks-dev-eu", false},
+		{"+[provider]", "+eks-prod-eu", false},
+		{"+[env=staging]", "", true},
+		{"+[]", "", true},
+		{"+[env=prod]foo", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := expandTagKspace(tt.kspace, kc.Contexts, &cfg)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("expandTagKspace(%q) error = %v, wantErr %v", tt.kspace, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("expandTagKspace(%q) = %q, want %q", tt.kspace, got, tt.want)
+		}
+	}
+}
+
+func TestDefaultNamespaces(t *testing.T) {
+	kc := &kubeconfig{CurrentContext: "dev"}
+	for _, c := range []struct{ name, ns string }{{"prod", "monitoring"}, {"stage", ""}, {"dev", "team-a"}} {
+		ctx := namedContext{Name: c.name}
+		ctx.Context.Namespace = c.ns
+		kc.Contexts = append(kc.Contexts, ctx)
+	}
+	clusters := map[string]Target{
+		"+prod":        {context: "prod"},
+		"+stage":       {context: "stage"},
+		"+stage:web":   {context: "stage", namespace: "web"},
+		":kube-system": {namespace: "kube-system"},
+		"@dev-cluster": {context: "dev", cluster: "dev-cluster"},
+	}
+
+	labeled, names := defaultNamespaces(clusters, []string{"get", "pods"}, envDefaults{}, kc)
+	want := "+prod:monitoring +stage:default +stage:web :kube-system @dev-cluster:team-a"
+	if got := strings.Join(names, " "); got != want {
+		t.Errorf("names = %q, want %q", got, want)
+	}
+	if c := labeled["+prod:monitoring"]; c.namespace != "" || c.effectiveNamespace != "monitoring" {
+		t.Errorf("namespace flag must not be added for context default: %+v", c)
+	}
+
+	// -n wins over the kspace's namespace too, see buildKubectlArgs
+	_, names = defaultNamespaces(clusters, []string{"get", "pods", "-n", "apps"}, envDefaults{}, kc)
+	if got := strings.Join(names, " "); got != "+prod:apps +stage:apps :apps @dev-cluster:apps" {
+		t.Errorf("explicit namespace flag not used: %v", names)
+	}
+
+	_, names = defaultNamespaces(clusters, []string{"get", "pods"}, envDefaults{namespace: "apps"}, kc)
+	if got := strings.Join(names, " "); got != "+prod:apps +stage:apps +stage:web :kube-system @dev-cluster:apps" {
+		t.Errorf("KUBE_NAMESPACE must not beat the kspace: %v", names)
+	}
+
+	_, names = defaultNamespaces(clusters, []string{"get", "pods", "-A"}, envDefaults{}, kc)
+	if names[0] != "+prod" {
+		t.Errorf("all namespaces should not be labeled: %v", names)
+	}
+}
+
+func TestParseKubectlArgs(t *testing.T) {
+	tests := []struct {
+		name      string
+		args      []string
+		flag      string
+		wantValue string
+		wantFound bool
+		wantVerb  string
+	}{
+		{"namespace long", []string{"get", "pods", "--namespace", "foo"}, "namespace", "foo", true, "get"},
+		{"namespace equals", []string{"get", "pods", "--namespace=foo"}, "namespace", "foo", true, "get"},
+		{"namespace short", []string{"get", "pods", "-n", "foo"}, "namespace", "foo", true, "get"},
+		{"namespace short joined", []string{"get", "pods", "-nfoo"}, "namespace", "foo", true, "get"},
+		{"namespace short equals", []string{"get", "pods", "-n=foo"}, "namespace", "foo", true, "get"},
+		{"namespace before verb", []string{"-n", "foo", "get", "pods"}, "namespace", "foo", true, "get"},
+		{"context equals", []string{"--context=prod", "get", "pods"}, "context", "prod", true, "get"},
+		{"kubeconfig equals", []string{"get", "--kubeconfig=/tmp/kc"}, "kubeconfig", "/tmp/kc", true, "get"},
+		{"grouped shorthand", []string{"exec", "-it", "pod"}, "tty", "true", true, "exec"},
+		{"grouped with value", []string{"get", "-Ao", "wide"}, "output", "wide", true, "get"},
+		{"logs -f is follow", []string{"logs", "-f", "pod"}, "follow", "true", true, "logs"},
+		{"apply -f is filename", []string{"apply", "-f", "x.yaml"}, "filename", "x.yaml", true, "apply"},
+		{"stops at double dash", []string{"exec", "pod", "--", "grep", "-n", "foo"}, "namespace", "", false, "exec"},
+		{"not given", []string{"get", "pods"}, "namespace", "", false, "get"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsed := parseKubectlArgs(tt.args)
+			value, found := parsed.value(tt.flag)
+			if value != tt.wantValue || found != tt.wantFound {
+				t.Errorf("value(%s) = (%q, %v), want (%q, %v)", tt.flag, value, found, tt.wantValue, tt.wantFound)
+			}
+			if parsed.verb != tt.wantVerb {
+				t.Errorf("verb = %q, want %q", parsed.verb, tt.wantVerb)
+			}
+		})
+	}
+}
+
+func TestSplitKspaces(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		wantKspaces []string
+		wantArgs    []string
+	}{
+		{"kspace first", []string{"+prod", "get", "pods"}, []string{"+prod"}, []string{"get", "pods"}},
+		{"kspace last", []string{"get", "pods", "@prod:default"}, []string{"@prod:default"}, []string{"get", "pods"}},
+		{"multiple kspaces", []string{"+a", ":kube-system", "get", "pods"}, []string{"+a", ":kube-system"}, []string{"get", "pods"}},
+		{"exec command after --", []string{"+prod", "exec", "pod", "--", "grep", ":8080", "file"}, []string{"+prod"}, []string{"exec", "pod", "--", "grep", ":8080", "file"}},
+		{"run command after --", []string{"run", "x", "--image=foo", "--", "sh", "-c", "@hourly"}, nil, []string{"run", "x", "--image=foo", "--", "sh", "-c", "@hourly"}},
+		{"flag value", []string{"get", "pods", "--selector", "+x", "+prod"}, []string{"+prod"}, []string{"get", "pods", "--selector", "+x"}},
+		{"command flag value", []string{"+eks", "create", "cronjob", "b", "--image=busybox", "--schedule", "@hourly"}, []string{"+eks"}, []string{"create", "cronjob", "b", "--image=busybox", "--schedule", "@hourly"}},
+		{"run flag values", []string{"run", "x", "--env", ":8080", "--labels", "+a", "--port", ":80", "+prod"}, []string{"+prod"}, []string{"run", "x", "--env", ":8080", "--labels", "+a", "--port", ":80"}},
+		{"optional flag value", []string{"apply", "--dry-run", "+prod", "-f", "x.yaml"}, []string{"+prod"}, []string{"apply", "--dry-run", "-f", "x.yaml"}},
+		{"no kspaces", []string{"get", "pods"}, nil, []string{"get", "pods"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kspaces, args := splitKspaces(tt.args)
+			if strings.Join(kspaces, " ") != strings.Join(tt.wantKspaces, " ") {
+				t.Errorf("kspaces = %q, want %q", kspaces, tt.wantKspaces)
+			}
+			if strings.Join(args, " ") != strings.Join(tt.wantArgs, " ") {
+				t.Errorf("args = %q, want %q", args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestBuildKubectlArgs(t *testing.T) {
+	env := envDefaults{context: "env-ctx", namespace: "env-ns"}
+	tests := []struct {
+		name    string
+		args    []string
+		cluster Target
+		env     envDefaults
+		want    string
+	}{
+		{"no target no env", []string{"get", "pods"}, Target{}, envDefaults{}, "get pods"},
+		{"env only", []string{"get", "pods"}, Target{}, env, "get pods --context env-ctx --namespace env-ns"},
+		{"kspace beats env", []string{"get", "pods"}, Target{context: "prod", namespace: "web"}, env, "get pods --context prod --namespace web"},
+		{"kspace context env namespace", []string{"get", "pods"}, Target{context: "prod"}, env, "get pods --context prod --namespace env-ns"},
+		{"namespace only kspace", []string{"get", "pods"}, Target{namespace: "web"}, env, "get pods --context env-ctx --namespace web"},
+		{"all namespaces kspace", []string{"get", "pods"}, Target{context: "prod", namespace: "*"}, env, "get pods --context prod --all-namespaces"},
+		{"flag beats kspace", []string{"get", "pods", "-nflag-ns"}, Target{context: "prod", namespace: "web"}, env, "get pods -nflag-ns --context prod"},
+		{"context flag beats kspace", []string{"get", "pods", "--context=flag-ctx"}, Target{context: "prod"}, env, "get pods --context=flag-ctx --namespace env-ns"},
+		{"all namespaces flag beats env", []string{"get", "pods", "-A"}, Target{}, env, "get pods -A --context env-ctx"},
+		{"flags go before --", []string{"exec", "pod", "--", "ls", "-n"}, Target{context: "prod", namespace: "web"}, envDefaults{}, "exec pod --context prod --namespace web -- ls -n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := strings.Join(buildKubectlArgs(tt.args, tt.cluster, tt.env), " ")
+			if got != tt.want {
+				t.Errorf("buildKubectlArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSingleTargetKeepsArguments(t *testing.T) {
+	// k get pods +prod used to drop "get" because the kspace was assumed
+	// to be the first argument
+	kspaces, args := splitKspaces([]string{"get", "pods", "+prod"})
+	clusters, names, err := ParseCluster(kspaces)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(buildKubectlArgs(args, clusters[names[0]], envDefaults{namespace: "env-ns"}), " ")
+	if got != "get pods --context prod --namespace env-ns" {
+		t.Errorf("single target args = %q", got)
+	}
+}
+
+func TestFindPlugin(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"kubectl-foo", "kubectl-foo-bar", "kubectl-cert_manager", "kubectl-get"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir)
+
+	tests := []struct {
+		name       string
+		args       []string
+		wantPlugin string
+		wantArgs   string
+		wantFound  bool
+	}{
+		{"plugin", []string{"foo", "x"}, "kubectl-foo", "x", true},
+		{"longest name wins", []string{"foo", "bar", "x"}, "kubectl-foo-bar", "x", true},
+		{"flags are kept", []string{"-v", "3", "foo", "baz", "-o", "json"}, "kubectl-foo", "-v 3 baz -o json", true},
+		{"dashes become underscores", []string{"cert-manager", "status"}, "kubectl-cert_manager", "status", true},
+		{"builtins can't be replaced", []string{"get", "pods"}, "", "", false},
+		{"unknown command", []string{"nope"}, "", "", false},
+		{"no command", []string{"-v", "3"}, "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, args, found := findPlugin(tt.args)
+			if found != tt.wantFound {
+				t.Fatalf("findPlugin() found = %v, want %v", found, tt.wantFound)
+			}
+			if !found {
+				return
+			}
+			if filepath.Base(path) != tt.wantPlugin {
+				t.Errorf("findPlugin() plugin = %s, want %s", filepath.Base(path), tt.wantPlugin)
+			}
+			if got := strings.Join(args, " "); got != tt.wantArgs {
+				t.Errorf("findPlugin() args = %q, want %q", got, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestFindKubectlSkipsSelf(t *testing.T) {
+	self, err := os.Executable()
+	if err != nil {
+		t.Skip(err)
+	}
+	// k installed as kubectl comes first on PATH, the real kubectl second
+	selfDir, realDir := t.TempDir(), t.TempDir()
+	if err := os.Symlink(self, filepath.Join(selfDir, "kubectl")); err != nil {
+		t.Skip(err)
+	}
+	real := filepath.Join(realDir, "kubectl")
+	if err := os.WriteFile(real, []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", selfDir+string(os.PathListSeparator)+realDir)
+
+	got, err := findKubectl()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != real {
+		t.Errorf("findKubectl() = %s, want %s", got, real)
+	}
+}
+
+func TestFindKubectlEnv(t *testing.T) {
+	dir := t.TempDir()
+	custom := filepath.Join(dir, "kubectl-1.27")
+	if err := os.WriteFile(custom, []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+
+	t.Setenv("K_KUBECTL", "kubectl-1.27")
+	if got, err := findKubectl(); err != nil || got != custom {
+		t.Errorf("findKubectl() = %s, %v, want %s", got, err, custom)
+	}
+
+	t.Setenv("K_KUBECTL", "kubectl-missing")
+	if _, err := findKubectl(); err == nil {
+		t.Error("findKubectl() with a missing K_KUBECTL should fail")
+	}
+}
+
+func TestContextSettings(t *testing.T) {
+	t.Setenv("HOME", "/home/me")
+	cfg := &kConfig{Contexts: []contextRule{
+		{Name: "legacy-*", Kubectl: "kubectl-1.27"},
+		{Name: "legacy-eu", Tags: map[string]string{"provider": "eks", "env": "prod"}},
+		{Name: "legacy-us", Kubectl: "/opt/kubectl-1.25"},
+		{Selector: "provider=eks", Env: map[string]string{"AWS_PROFILE": "default", "AWS_REGION": "eu-west-1"}},
+		{Selector: "provider=eks,env=prod", Env: map[string]string{"AWS_PROFILE": "prod"}},
+		{Name: "gke_*", Env: map[string]string{"CLOUDSDK_CONFIG": "$HOME/.gcloud-work"}},
+	}}
+
+	tests := []struct {
+		context     string
+		wantKubectl string
+		wantEnv     string
+	}{
+		{"legacy-eu", "kubectl-1.27", "AWS_PROFILE=prod AWS_REGION=eu-west-1"},
+		{"legacy-us", "/opt/kubectl-1.25", ""},
+		{"gke_acme_prod", "", "CLOUDSDK_CONFIG=/home/me/.gcloud-work"},
+		{"prod", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.context, func(t *testing.T) {
+			settings, err := contextSettings(namedContext{Name: tt.context}, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if settings.Kubectl != tt.wantKubectl {
+				t.Errorf("contextSettings(%s) kubectl = %q, want %q", tt.context, settings.Kubectl, tt.wantKubectl)
+			}
+			var got []string
+			for _, k := range sortedKeys(settings.Env) {
+				got = append(got, k+"="+settings.Env[k])
+			}
+			if strings.Join(got, " ") != tt.wantEnv {
+				t.Errorf("contextSettings(%s) env = %q, want %q", tt.context, strings.Join(got, " "), tt.wantEnv)
+			}
+		})
+	}
+}
+
+func TestTargetContext(t *testing.T) {
+	env := envDefaults{context: "env-ctx"}
+	tests := []struct {
+		name    string
+		args    []string
+		cluster Target
+		want    string
+	}{
+		{"flag", []string{"get", "pods", "--context=flag-ctx"}, Target{context: "prod"}, "flag-ctx"},
+		{"kspace", []string{"get", "pods"}, Target{context: "prod"}, "prod"},
+		{"env", []string{"get", "pods"}, Target{namespace: "web"}, "env-ctx"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := targetContext(tt.args, tt.cluster, env); got != tt.want {
+				t.Errorf("targetContext() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestMain lets the test binary stand in for k when a test starts one of
+// k's hidden commands, like the tunnel supervisor
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == tunnelSupervisorCommand {
+		os.Exit(runTunnelSupervisor(os.Args[2:]))
+	}
+	os.Exit(m.Run())
+}
+
+// TestTunnelHelperProcess is the stand-in tunnel command started by the
+// tunnel tests. It listens on the port it's given until it's killed.
+func TestTunnelHelperProcess(t *testing.T) {
+	if os.Getenv("K_TEST_TUNNEL") != "1" {
+		return
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:"+os.Args[len(os.Args)-1])
+	if err != nil {
+		os.Exit(2)
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			os.Exit(0)
+		}
+		conn.Close()
+	}
+}
+
+// runTestExitHooks runs and clears the exit hooks registered by a test
+func runTestExitHooks() {
+	exitHooksMu.Lock()
+	hooks := exitHooks
+	exitHooks = nil
+	exitHooksMu.Unlock()
+	for _, fn := range hooks {
+		fn()
+	}
+	openTunnelsMu.Lock()
+	openTunnels = make(map[string]string)
+	openTunnelsMu.Unlock()
+}
+
+func TestOpenTunnel(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("K_TEST_TUNNEL", "1")
+	defer runTestExitHooks()
+	command := []string{os.Args[0], "-test.run=TestTunnelHelperProcess", "--", "{port}"}
+
+	proxy, err := openTunnel(tunnelConfig{Proxy: "http://proxy.example.com:3128"})
+	if err != nil || proxy != "http://proxy.example.com:3128" {
+		t.Errorf("openTunnel() with a proxy = %q, %v", proxy, err)
+	}
+
+	proxy, err = openTunnel(tunnelConfig{Command: command})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(strings.TrimPrefix(proxy, "socks5://127.0.0.1:"))
+	if err != nil {
+		t.Fatalf("openTunnel() = %q, want a socks5 proxy on localhost", proxy)
+	}
+	if !tunnelListening(port) {
+		t.Fatalf("tunnel isn't listening on %d", port)
+	}
+
+	// targets sharing a tunnel get the same one
+	if again, _ := openTunnel(tunnelConfig{Command: command}); again != proxy {
+		t.Errorf("second openTunnel() = %q, want %q", again, proxy)
+	}
+
+	// the tunnel is stopped when k exits
+	runTestExitHooks()
+	deadline := time.Now().Add(5 * time.Second)
+	for tunnelListening(port) && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if tunnelListening(port) {
+		t.Error("tunnel still listening after exit")
+	}
+}
+
+func TestOpenTunnelKeptWhileIdle(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("K_TEST_TUNNEL", "1")
+	defer runTestExitHooks()
+	tunnel := tunnelConfig{
+		Command: []string{os.Args[0], "-test.run=TestTunnelHelperProcess", "--", "{port}"},
+		Idle:    time.Minute,
+	}
+
+	proxy, err := openTunnel(tunnel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := readTunnelState()
+	defer func() {
+		for _, s := range state {
+			if p, err := os.FindProcess(s.Pid); err == nil {
+				p.Signal(os.Interrupt)
+			}
+		}
+		// the supervisor forgets the tunnel as it exits
+		deadline := time.Now().Add(5 * time.Second)
+		for len(readTunnelState()) > 0 && time.Now().Before(deadline) {
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+
+	// a later run reuses the tunnel
+	runTestExitHooks()
+	again, err := openTunnel(tunnel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != proxy {
+		t.Errorf("openTunnel() after exit = %q, want kept tunnel %q", again, proxy)
+	}
+}
+
+func TestKeptTunnelStopsWhenIdle(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("K_TEST_TUNNEL", "1")
+	defer runTestExitHooks()
+	tunnel := tunnelConfig{
+		Command: []string{os.Args[0], "-test.run=TestTunnelHelperProcess", "--", "{port}"},
+		Idle:    500 * time.Millisecond,
+	}
+
+	proxy, err := openTunnel(tunnel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(strings.TrimPrefix(proxy, "socks5://127.0.0.1:"))
+
+	// it's kept while k runs, even for longer than the idle timeout
+	time.Sleep(time.Second)
+	if !tunnelListening(port) {
+		t.Fatal("tunnel stopped while k was using it")
+	}
+
+	// and stops itself once k has exited, without another k run
+	runTestExitHooks()
+	deadline := time.Now().Add(5 * time.Second)
+	for tunnelListening(port) && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if tunnelListening(port) {
+		t.Fatal("idle tunnel still listening")
+	}
+	for len(readTunnelState()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if state := readTunnelState(); len(state) > 0 {
+		t.Errorf("tunnel state = %v, want the stopped tunnel forgotten", state)
+	}
+}
+
+func TestOpenTunnelFails(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	defer runTestExitHooks()
+	// without K_TEST_TUNNEL the helper exits straight away
+	_, err := openTunnel(tunnelConfig{Command: []string{os.Args[0], "-test.run=TestTunnelHelperProcess", "--", "{port}"}})
+	if err == nil || !strings.Contains(err.Error(), "exited") {
+		t.Errorf("openTunnel() error = %v, want the tunnel to have exited", err)
+	}
+}
+
+func TestShimKubeconfig(t *testing.T) {
+	users := []namedUser{
+		{"eks", json.RawMessage(`{"exec":{"apiVersion":"client.authentication.k8s.io/v1beta1","command":"aws","args":["eks","get-token"],"env":[{"name":"AWS_PROFILE","value":"prod"}]}}`)},
+		{"token", json.RawMessage(`{"token":"REDACTED"}`)},
+		{"mixed", json.RawMessage(`{"exec":{"command":"aws"},"client-certificate":"/tmp/cert"}`)},
+		{"relative", json.RawMessage(`{"exec":{"command":"./bin/auth"}}`)},
+	}
+
+	data, n, err := shimKubeconfig(users, "/usr/local/bin/k", "/home/me/.kube/config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("shimKubeconfig() shimmed %d users, want 1", n)
+	}
+	var kc struct {
+		Users []struct {
+			Name string `json:"name"`
+			User struct {
+				Exec struct {
+					Command string   `json:"command"`
+					Args    []string `json:"args"`
+					Env     []any    `json:"env"`
+				} `json:"exec"`
+			} `json:"user"`
+		} `json:"users"`
+	}
+	if err := json.Unmarshal(data, &kc); err != nil {
+		t.Fatal(err)
+	}
+	exec := kc.Users[0].User.Exec
+	if kc.Users[0].Name != "eks" || exec.Command != "/usr/local/bin/k" || len(exec.Env) != 1 {
+		t.Errorf("shimKubeconfig() user = %+v", kc.Users[0])
+	}
+	if len(exec.Args) != 6 || exec.Args[0] != credentialShimCommand || strings.Join(exec.Args[2:], " ") != "-- aws eks get-token" {
+		t.Errorf("shimKubeconfig() args = %q", exec.Args)
+	}
+
+	// the same user in another kubeconfig may be someone else
+	other, _, _ := shimKubeconfig(users, "/usr/local/bin/k", "/home/me/.kube/other")
+	if bytes.Equal(data, other) {
+		t.Error("shimKubeconfig() cache key doesn't depend on the kubeconfig")
+	}
+}
+
+func TestCredentialShimCaches(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	plugin := filepath.Join(dir, "auth")
+	expires := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	script := "#!/bin/sh\necho x >> " + calls + "\nsleep 0.2\n" +
+		`echo '{"kind":"ExecCredential","status":{"token":"t","expirationTimestamp":"` + expires + `"}}'` + "\n"
+	if err := os.WriteFile(plugin, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	// kubectls for many targets ask for the same credential at once
+	var wg sync.WaitGroup
+	outputs := make([]string, 5)
+	for i := range outputs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var out bytes.Buffer
+			if code := runCredentialShim([]string{"key", "--", plugin}, &out); code != 0 {
+				t.Errorf("runCredentialShim() = %d", code)
+			}
+			outputs[i] = out.String()
+		}(i)
+	}
+	wg.Wait()
+
+	data, _ := os.ReadFile(calls)
+	if n := strings.Count(string(data), "x"); n != 1 {
+		t.Errorf("plugin ran %d times, want 1", n)
+	}
+	for _, out := range outputs {
+		if !strings.Contains(out, `"token":"t"`) || out != outputs[0] {
+			t.Errorf("runCredentialShim() output = %q", out)
+		}
+	}
+}
+
+func TestCredentialShimKeyUsesEnv(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	plugin := filepath.Join(dir, "auth")
+	expires := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	script := "#!/bin/sh\necho $AWS_PROFILE >> " + calls + "\n" +
+		`echo '{"status":{"token":"'$AWS_PROFILE'","expirationTimestamp":"` + expires + `"}}'` + "\n"
+	if err := os.WriteFile(plugin, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, profile := range []string{"dev", "prod", "dev"} {
+		t.Setenv("AWS_PROFILE", profile)
+		var out bytes.Buffer
+		runCredentialShim([]string{"key", "--", plugin}, &out)
+		if !strings.Contains(out.String(), `"token":"`+profile+`"`) {
+			t.Errorf("AWS_PROFILE=%s got credential %q", profile, out.String())
+		}
+	}
+	data, _ := os.ReadFile(calls)
+	if got := strings.Fields(string(data)); strings.Join(got, " ") != "dev prod" {
+		t.Errorf("plugin ran for %q, want dev and prod once each", got)
+	}
+}
+
+func TestCredentialShimSkipsExpired(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	plugin := filepath.Join(dir, "auth")
+	// expires within the skew so it's never reused
+	expires := time.Now().Add(10 * time.Second).UTC().Format(time.RFC3339)
+	script := "#!/bin/sh\necho x >> " + calls + "\n" +
+		`echo '{"status":{"token":"t","expirationTimestamp":"` + expires + `"}}'` + "\n"
+	if err := os.WriteFile(plugin, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		runCredentialShim([]string{"key", "--", plugin}, &bytes.Buffer{})
+	}
+	data, _ := os.ReadFile(calls)
+	if n := strings.Count(string(data), "x"); n != 2 {
+		t.Errorf("plugin ran %d times, want 2", n)
+	}
+}
+
+func TestExtractKFlagsPreflight(t *testing.T) {
+	opts, _, err := extractKFlags([]string{"get", "pods", "--k-preflight"})
+	if err != nil || opts.preflight != defaultProbeTimeout {
+		t.Errorf("--k-preflight = %v, %v, want %v", opts.preflight, err, defaultProbeTimeout)
+	}
+	opts, _, err = extractKFlags([]string{"get", "pods", "--k-preflight=800ms"})
+	if err != nil || opts.preflight != 800*time.Millisecond {
+		t.Errorf("--k-preflight=800ms = %v, %v", opts.preflight, err)
+	}
+	if _, _, err := extractKFlags([]string{"--k-preflight=soon"}); err == nil {
+		t.Error("--k-preflight=soon should fail")
+	}
+}
+
+func TestExpandContextGlob(t *testing.T) {
+	contexts := []string{"prod-us", "prod-eu", "stage", "dev"}
+	tests := []struct {
+		kspace  string
+		want    string
+		wantErr bool
+	}{
+		{"+*", "+dev,prod-eu,prod-us,stage", false},
+		{"+prod-*:kube-system", "+prod-eu,prod-us:kube-system", false},
+		{"+prod-*,dev", "+prod-eu,prod-us,dev", false},
+		{"+qa-*", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kspace, func(t *testing.T) {
+			if !isContextGlob(tt.kspace) {
+				t.Fatalf("isContextGlob(%s) = false", tt.kspace)
+			}
+			got, err := expandContextGlob(tt.kspace, contexts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expandContextGlob() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("expandContextGlob() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+	for _, kspace := range []string{"+prod", "+[env=prod]", ":team-*", "@prod-*"} {
+		if isContextGlob(kspace) {
+			t.Errorf("isContextGlob(%s) = true", kspace)
+		}
+	}
+}
+
+// fakeKubectl writes a kubectl stand-in running script and returns it as a
+// kubectlRunner
+func fakeKubectl(t *testing.T, script string) kubectlRunner {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "kubectl")
+	if err := os.WriteFile(p, []byte("#!/bin/sh\n"+script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return kubectlRunner{binary: p}
+}
+
+func TestProbeTargets(t *testing.T) {
+	// prod answers, stage hangs and broken fails straight away
+	x := fakeKubectl(t, `case "$*" in
+*"--context stage"*) sleep 5 ;;
+*"--context broken"*) echo 'error: dial tcp 10.0.0.1:443: connect: connection refused' >&2; exit 1 ;;
+*/version*) echo '{"gitVersion":"v1.29.3"}' ;;
+*) echo ok ;;
+esac
+`)
+	clusters := map[string]Target{
+		"+prod:a": {context: "prod", namespace: "a"},
+		"+prod:b": {context: "prod", namespace: "b"},
+		"+stage":  {context: "stage"},
+		"+broken": {context: "broken"},
+	}
+	runners := make(map[string]Runner)
+	for name := range clusters {
+		runners[name] = x
+	}
+
+	started := time.Now()
+	results := probeTargets(clusters, runners, envDefaults{}, 100*time.Millisecond, true)
+	if elapsed := time.Since(started); elapsed > 3*time.Second {
+		t.Errorf("probeTargets() took %s, unreachable targets should time out", elapsed)
+	}
+
+	for _, name := range []string{"+prod:a", "+prod:b"} {
+		if r := results[name]; r.err != nil || r.version != "v1.29.3" {
+			t.Errorf("%s = %+v, want reachable v1.29.3", name, r)
+		}
+	}
+	if r := results["+stage"]; r.err == nil {
+		t.Error("+stage should be unreachable")
+	}
+	if r := results["+broken"]; r.err == nil || !strings.Contains(r.err.Error(), "connection refused") {
+		t.Errorf("+broken error = %v, want kubectl's error", r.err)
+	}
+
+	var out bytes.Buffer
+	if printPing(&out, []string{"+broken", "+prod:a"}, results) {
+		t.Error("printPing() = true with an unreachable target")
+	}
+	if !strings.Contains(out.String(), "unreachable") || !strings.Contains(out.String(), "v1.29.3") {
+		t.Errorf("printPing() output:\n%s", out.String())
+	}
+}
+
+func TestExtractKFlagsTimeoutRetries(t *testing.T) {
+	opts, args, err := extractKFlags([]string{"get", "pods", "--k-timeout", "30s", "--k-retries=2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.timeout != 30*time.Second || opts.retries != 2 || strings.Join(args, " ") != "get pods" {
+		t.Errorf("extractKFlags() = %+v, %v", opts, args)
+	}
+	for _, args := range [][]string{{"--k-timeout", "soon"}, {"--k-retries", "-1"}, {"--k-retries"}} {
+		if _, _, err := extractKFlags(args); err == nil {
+			t.Errorf("extractKFlags(%v) should fail", args)
+		}
+	}
+}
+
+func TestRetryKubectl(t *testing.T) {
+	defer func(opts kOptions) { kOpts = opts }(kOpts)
+	kOpts = kOptions{retries: 2, collect: "table"}
+
+	tests := []struct {
+		name      string
+		args      []string
+		failures  int
+		wantCalls int
+		wantCode  int
+	}{
+		{"get recovers", []string{"get", "pods"}, 1, 2, 0},
+		{"get gives up", []string{"get", "pods"}, 5, 3, 1},
+		{"apply isn't retried", []string{"apply", "-f", "x.yaml"}, 1, 1, 1},
+		{"watch isn't retried", []string{"get", "pods", "-w"}, 1, 1, 1},
+		{"success", []string{"describe", "pod", "web"}, 0, 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			code := retryKubectl(tt.args, "+prod", func() int {
+				calls++
+				if calls <= tt.failures {
+					return 1
+				}
+				return 0
+			})
+			if calls != tt.wantCalls || code != tt.wantCode {
+				t.Errorf("retryKubectl() = %d after %d calls, want %d after %d", code, calls, tt.wantCode, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	want := []time.Duration{500 * time.Millisecond, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, maxRetryBackoff, maxRetryBackoff}
+	for i, w := range want {
+		if got := retryBackoff(i + 1); got != w {
+			t.Errorf("retryBackoff(%d) = %s, want %s", i+1, got, w)
+		}
+	}
+}
+
+func TestCollectKubectlTimeout(t *testing.T) {
+	defer func(opts kOptions) { kOpts = opts }(kOpts)
+	kOpts = kOptions{timeout: 100 * time.Millisecond, collect: "table"}
+	x := fakeKubectl(t, `case "$*" in
+*slow*) exec sleep 5 ;;
+*) echo fast ;;
+esac
+`)
+
+	started := time.Now()
+	result := collectKubectl([]string{"get", "slow"}, "+vpn", x)
+	if time.Since(started) > 3*time.Second {
+		t.Errorf("collectKubectl() took %s, want it killed after the timeout", time.Since(started))
+	}
+	if result.ExitCode != timeoutExitCode || !strings.Contains(result.Stderr, "timed out") {
+		t.Errorf("collectKubectl() = %+v, want a timeout", result)
+	}
+
+	result = collectKubectl([]string{"get", "fast"}, "+prod", x)
+	if result.ExitCode != 0 || result.Stdout != "fast\n" {
+		t.Errorf("collectKubectl() = %+v", result)
+	}
+}
+
+// resetInterrupt undoes interrupt so tests can interrupt k again
+func resetInterrupt() {
+	interruptedByMu.Lock()
+	interruptedBy = nil
+	interruptedByMu.Unlock()
+	rootCtx, cancelRoot = context.WithCancel(context.Background())
+}
+
+// startFakeKubectl starts a fake kubectl running script and waits until it
+// has set up its traps
+func startFakeKubectl(t *testing.T, script string) (*exec.Cmd, string) {
+	t.Helper()
+	out := filepath.Join(t.TempDir(), "out")
+	ready := filepath.Join(t.TempDir(), "ready")
+	x := fakeKubectl(t, script+"\ntouch "+ready+"\nwhile :; do sleep 0.05; done\n")
+	cmd := x.Command([]string{out})
+	if err := startChild(cmd); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(ready); err == nil {
+			return cmd, out
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("fake kubectl didn't start")
+	return nil, ""
+}
+
+func TestInterruptForwardsSignal(t *testing.T) {
+	resetInterrupt()
+	defer resetInterrupt()
+
+	cmd, out := startFakeKubectl(t, `trap 'echo INT > "$1"; exit 0' INT`)
+	interrupt(syscall.SIGINT)
+
+	done := make(chan struct{})
+	go func() {
+		waitChild(cmd)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("fake kubectl didn't exit after SIGINT")
+	}
+	if data, _ := os.ReadFile(out); strings.TrimSpace(string(data)) != "INT" {
+		t.Errorf("fake kubectl got %q, want INT", data)
+	}
+	if code := signalExitCode(interruptSignal()); code != 130 {
+		t.Errorf("exit code = %d, want 130", code)
+	}
+
+	// nothing new starts once k is interrupted
+	if err := startChild(fakeKubectl(t, "exit 0").Command(nil)); err == nil {
+		t.Error("startChild() after interrupt should fail")
+	}
+}
+
+func TestInterruptKillsAfterGrace(t *testing.T) {
+	resetInterrupt()
+	defer resetInterrupt()
+	defer func(d time.Duration) { shutdownGrace = d }(shutdownGrace)
+	shutdownGrace = 200 * time.Millisecond
+
+	cmd, _ := startFakeKubectl(t, `trap '' INT TERM`)
+	interrupt(syscall.SIGTERM)
+
+	done := make(chan struct{})
+	go func() {
+		waitChild(cmd)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("fake kubectl ignoring SIGTERM wasn't killed after the grace period")
+	}
+	if code := signalExitCode(interruptSignal()); code != 143 {
+		t.Errorf("exit code = %d, want 143", code)
+	}
+}
+
+func TestSignalChildrenResize(t *testing.T) {
+	if len(resizeSignals) == 0 {
+		t.Skip("no resize signal on this platform")
+	}
+	resetInterrupt()
+	defer resetInterrupt()
+
+	cmd, out := startFakeKubectl(t, `trap 'echo WINCH > "$1"' WINCH`)
+	defer func() {
+		cmd.Process.Kill()
+		waitChild(cmd)
+	}()
+	signalChildren(resizeSignals[0])
+
+	for i := 0; i < 100; i++ {
+		if data, _ := os.ReadFile(out); strings.TrimSpace(string(data)) == "WINCH" {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Error("fake kubectl didn't get SIGWINCH")
+}
+
+// captureOutput runs fn with os.Stdout and os.Stderr going to pipes and
+// returns what was written to them
+func captureOutput(t *testing.T, fn func()) (string, string) {
+	t.Helper()
+	read := func(f **os.File) func() string {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved := *f
+		*f = w
+		done := make(chan string)
+		go func() {
+			var buf bytes.Buffer
+			buf.ReadFrom(r)
+			done <- buf.String()
+		}()
+		return func() string {
+			*f = saved
+			w.Close()
+			return <-done
+		}
+	}
+	stdout, stderr := read(&os.Stdout), read(&os.Stderr)
+	fn()
+	return stdout(), stderr()
+}
+
+// useConfigs makes kc the merged kubeconfig and cfg the k config for the
+// rest of the test
+func useConfigs(t *testing.T, kc *kubeconfig, cfg *kConfig) {
+	t.Helper()
+	kubeconfigOnce, kConfigOnce = sync.Once{}, sync.Once{}
+	kubeconfigOnce.Do(func() {})
+	kConfigOnce.Do(func() {})
+	loadedKubeconfig, kubeconfigErr = kc, nil
+	loadedKConfig, kConfigErr = cfg, nil
+	t.Cleanup(func() {
+		kubeconfigOnce, kConfigOnce = sync.Once{}, sync.Once{}
+		loadedKubeconfig, loadedKConfig = nil, nil
+	})
+}
+
+// runTestTargets runs runTargets for targets with every target using r and
+// resets the prefixes afterwards
+func runTestTargets(t *testing.T, targets map[string]Target, args []string, runnerFor func(Target) Runner) (int, string, string) {
+	t.Helper()
+	defer func() {
+		prefixWidth = 0
+		prefixColors = map[string]goocolor.Color{}
+	}()
+	var code int
+	stdout, stderr := captureOutput(t, func() {
+		code = runTargets(targets, mapKeys(targets), args, envDefaults{}, runnerFor)
+	})
+	return code, stdout, stderr
+}
+
+func TestRunTargets(t *testing.T) {
+	x := fakeKubectl(t, `echo "$@"
+case "$*" in
+*"--context broken"*) echo 'error: connection refused' >&2; exit 3 ;;
+esac
+`)
+	targets := map[string]Target{
+		"+prod:web": {context: "prod", namespace: "web"},
+		"+stage":    {context: "stage"},
+		"+broken":   {context: "broken"},
+	}
+	var ran []string
+	var mu sync.Mutex
+	code, stdout, stderr := runTestTargets(t, targets, []string{"get", "pods"}, func(target Target) Runner {
+		mu.Lock()
+		defer mu.Unlock()
+		ran = append(ran, target.context)
+		return x
+	})
+
+	if code != 3 {
+		t.Errorf("runTargets() = %d, want the exit code of the failed target", code)
+	}
+	if len(ran) != 3 {
+		t.Errorf("runTargets() asked for runners for %v, want every target", ran)
+	}
+	for _, want := range []string{
+		"+prod:web  get pods --context prod --namespace web\n",
+		"+stage     get pods --context stage\n",
+		"+broken    get pods --context broken\n",
+	} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("stdout = %q, want a line %q", stdout, want)
+		}
+	}
+	if stderr != "+broken    error: connection refused\n" {
+		t.Errorf("stderr = %q", stderr)
+	}
+}
+
+func TestRunTargetsGrepKeepsStderr(t *testing.T) {
+	defer func() { kOpts = kOptions{} }()
+	kOpts.grep = regexp.MustCompile("foo")
+	x := fakeKubectl(t, `echo foo; echo bar
+echo 'error: pods "x" not found' >&2
+exit 1
+`)
+	targets := map[string]Target{"+prod": {context: "prod"}, "+stage": {context: "stage"}}
+	_, stdout, stderr := runTestTargets(t, targets, []string{"get", "pods"}, func(Target) Runner { return x })
+
+	if strings.Contains(stdout, "bar") || !strings.Contains(stdout, "+prod   foo\n") {
+		t.Errorf("stdout = %q, want only lines matching --k-grep", stdout)
+	}
+	if !strings.Contains(stderr, `+prod   error: pods "x" not found`) {
+		t.Errorf("stderr = %q, want kubectl's errors whatever --k-grep is", stderr)
+	}
+}
+
+func TestRunTargetsEnv(t *testing.T) {
+	var kc kubeconfig
+	for _, name := range []string{"eks-prod", "gke-prod"} {
+		kc.Contexts = append(kc.Contexts, namedContext{Name: name})
+	}
+	useConfigs(t, &kc, &kConfig{Contexts: []contextRule{
+		{Name: "eks-*", Env: map[string]string{"AWS_PROFILE": "prod"}},
+	}})
+	x := fakeKubectl(t, `echo "AWS_PROFILE=$AWS_PROFILE KUBECONFIG=$KUBECONFIG"`)
+	x.kubeconfig = "/tmp/merged"
+
+	targets := map[string]Target{
+		"+eks-prod": {context: "eks-prod"},
+		"+gke-prod": {context: "gke-prod"},
+	}
+	code, stdout, _ := runTestTargets(t, targets, []string{"get", "pods"}, func(target Target) Runner {
+		r, err := runnerForContext(x, target.context)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	})
+
+	if code != 0 {
+		t.Errorf("runTargets() = %d", code)
+	}
+	for _, want := range []string{
+		"+eks-prod  AWS_PROFILE=prod KUBECONFIG=/tmp/merged\n",
+		"+gke-prod  AWS_PROFILE= KUBECONFIG=/tmp/merged\n",
+	} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("stdout = %q, want a line %q", stdout, want)
+		}
+	}
+}
+
+func TestParseClusterFindsContext(t *testing.T) {
+	var kc kubeconfig
+	for _, c := range [][2]string{{"prod-admin", "prod"}, {"stage-admin", "stage"}} {
+		ctx := namedContext{Name: c[0]}
+		ctx.Context.Cluster = c[1]
+		kc.Contexts = append(kc.Contexts, ctx)
+	}
+	useConfigs(t, &kc, &kConfig{})
+
+	targets, names, err := ParseCluster([]string{"@stage:web", "@missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, " ") != "@stage:web @missing" {
+		t.Errorf("ParseCluster() names = %q, want them in order", names)
+	}
+	want := Target{cluster: "stage", context: "stage-admin", namespace: "web"}
+	if got := targets["@stage:web"]; got != want {
+		t.Errorf("ParseCluster(@stage:web) = %+v, want %+v", got, want)
+	}
+	if got := targets["@missing"]; got.context != "" {
+		t.Errorf("ParseCluster(@missing) context = %q, want none", got.context)
+	}
+}
+
+func TestIsPortForwardCommand(t *testing.T) {
+	tests := []struct {
+		args []string
+		want bool
+	}{
+		{[]string{"port-forward", "svc/y", "3000"}, true},
+		{[]string{"-n", "x", "port-forward", "svc/y", "3000"}, true},
+		{[]string{"--context=prod", "port-forward", "svc/y", "3000"}, true},
+		{[]string{"get", "pods", "port-forward"}, false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := isPortForwardCommand(tt.args); got != tt.want {
+			t.Errorf("isPortForwardCommand(%q) = %v, want %v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestSuperviseKubectlGivesUp(t *testing.T) {
+	calls := filepath.Join(t.TempDir(), "calls")
+	x := fakeKubectl(t, "echo x >> "+calls+"\necho 'Error from server (NotFound): services \"typo\" not found' >&2\nexit 1\n")
+
+	var code int
+	_, stderr := captureOutput(t, func() {
+		code = superviseKubectl([]string{"port-forward", "svc/typo", "3000"}, "+prod", x)
+	})
+	if code != 1 {
+		t.Errorf("superviseKubectl() = %d, want kubectl's exit code", code)
+	}
+	if data, _ := os.ReadFile(calls); strings.Count(string(data), "x") != 1 {
+		t.Errorf("kubectl ran %d times, want a forward that never came up not to be retried", strings.Count(string(data), "x"))
+	}
+	if !strings.Contains(stderr, "not found") {
+		t.Errorf("stderr = %q, want kubectl's error", stderr)
+	}
+}
+
+func TestCheckClustersFound(t *testing.T) {
+	targets := map[string]Target{
+		"+prod":  {context: "prod"},
+		"@stage": {cluster: "stage", context: "stage-admin"},
+	}
+	if err := checkClustersFound(targets); err != nil {
+		t.Errorf("checkClustersFound() = %v, want nil", err)
+	}
+	targets["@typo"] = Target{cluster: "typo"}
+	if err := checkClustersFound(targets); err == nil || err.Error() != "@typo: no context found for cluster typo" {
+		t.Errorf("checkClustersFound() = %v, want @typo not found", err)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	log := newLogger(&buf, "", slog.LevelInfo)
+	log.Debug("hidden")
+	log.Info("plain")
+	log.Warn("not caching credentials", "error", errors.New("no exec users"))
+	log.Error("no context found")
+	want := "plain\nWarning: not caching credentials error=\"no exec users\"\nError: no context found\n"
+	if buf.String() != want {
+		t.Errorf("text output = %q, want %q", buf.String(), want)
+	}
+
+	buf.Reset()
+	log = newLogger(&buf, "json", slog.LevelDebug)
+	log.Debug("running kubectl", "kspace", "+prod", "args", []string{"get", "pods"})
+	var line struct {
+		Level  string   `json:"level"`
+		Msg    string   `json:"msg"`
+		Kspace string   `json:"kspace"`
+		Args   []string `json:"args"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("json output %q: %v", buf.String(), err)
+	}
+	if line.Level != "DEBUG" || line.Msg != "running kubectl" || line.Kspace != "+prod" || len(line.Args) != 2 {
+		t.Errorf("json output = %+v", line)
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	tests := []struct {
+		level string
+		debug bool
+		want  slog.Level
+	}{
+		{"", false, slog.LevelInfo},
+		{"debug", false, slog.LevelDebug},
+		{"WARN", false, slog.LevelWarn},
+		{"bogus", false, slog.LevelInfo},
+		{"error", true, slog.LevelDebug},
+	}
+	for _, tt := range tests {
+		t.Setenv("K_LOG_LEVEL", tt.level)
+		if tt.debug {
+			t.Setenv("K_DEBUG", "1")
+		} else {
+			// Setenv restores K_DEBUG after the test
+			t.Setenv("K_DEBUG", "")
+			os.Unsetenv("K_DEBUG")
+		}
+		if got := logLevel(); got != tt.want {
+			t.Errorf("logLevel() with K_LOG_LEVEL=%q K_DEBUG=%v = %v, want %v", tt.level, tt.debug, got, tt.want)
+		}
+	}
+}
+
+// useCompletionConfigs sets up a kubeconfig with prod and stage contexts
+// and a kubectl listing each context's namespaces
+func useCompletionConfigs(t *testing.T) kubectlRunner {
+	t.Helper()
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	kc := kubeconfig{CurrentContext: "prod"}
+	for _, c := range [][2]string{{"prod", "prod-cluster"}, {"stage", "stage-cluster"}} {
+		ctx := namedContext{Name: c[0]}
+		ctx.Context.Cluster = c[1]
+		kc.Contexts = append(kc.Contexts, ctx)
+		kc.Clusters = append(kc.Clusters, namedCluster{Name: c[1]})
+	}
+	useConfigs(t, &kc, &kConfig{Contexts: []contextRule{{Name: "prod", Tags: map[string]string{"env": "prod"}}}})
+
+	runner := fakeKubectl(t, `case "$*" in
+*"--context stage"*) echo namespace/default namespace/stage-web ;;
+*) echo namespace/default namespace/prod-web ;;
+esac
+`)
+	saved := defaultRunner
+	defaultRunner = runner
+	t.Cleanup(func() { defaultRunner = saved })
+	return runner
+}
+
+func TestCompleteKspaces(t *testing.T) {
+	runner := useCompletionConfigs(t)
+	tests := []struct {
+		args       []string
+		toComplete string
+		want       string
+	}{
+		{nil, "+", "+prod\n+stage\n:6\n"},
+		{nil, "+prod,", "+prod,stage\n:6\n"},
+		{nil, "@s", "@stage-cluster\n:6\n"},
+		{nil, "+[", "+[env=prod]\n:6\n"},
+		// namespaces come from the kspace's own context
+		{nil, "+stage:", "+stage:default\n+stage:stage-web\n:4\n"},
+		{nil, "@stage-cluster:s", "@stage-cluster:stage-web\n:4\n"},
+		{nil, "+prod,stage:default,", "+prod,stage:default,prod-web\n+prod,stage:default,stage-web\n:4\n"},
+		{[]string{"get", "pods"}, ":p", ":prod-web\n:4\n"},
+		{[]string{"--context", "stage", "get"}, ":s", ":stage-web\n:4\n"},
+		{[]string{"--k-timestamps"}, "+p", "+prod\n:6\n"},
+		{nil, "--k-ret", "--k-retries\tretry failed read-only commands\n:4\n"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		complete(runner, tt.args, tt.toComplete, envDefaults{}, &buf)
+		if buf.String() != tt.want {
+			t.Errorf("complete(%q, %q) = %q, want %q", tt.args, tt.toComplete, buf.String(), tt.want)
+		}
+	}
+}
+
+func TestRunCompleteReadsKubeconfigFiles(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", dir)
+	t.Setenv("K_CONFIG", filepath.Join(dir, "none.yaml"))
+	kubeconfigs := []string{filepath.Join(dir, "a.yaml"), filepath.Join(dir, "b.yaml")}
+	os.WriteFile(kubeconfigs[0], []byte(`current-context: prod
+contexts:
+- name: prod
+  context: {cluster: prod-cluster}
+clusters:
+- name: prod-cluster
+  cluster: {server: https://prod}
+`), 0o600)
+	os.WriteFile(kubeconfigs[1], []byte(`current-context: stage
+contexts:
+- name: stage
+  context: {cluster: stage-cluster, namespace: web}
+- name: prod
+  context: {cluster: shadowed}
+`), 0o600)
+	t.Setenv("KUBECONFIG", strings.Join(kubeconfigs, string(os.PathListSeparator)))
+
+	calls := filepath.Join(dir, "calls")
+	kubectl := fakeKubectl(t, "echo \"$*\" >> "+calls+"\necho namespace/default namespace/stage-web\n")
+	t.Setenv("K_KUBECTL", kubectl.binary)
+	saved := defaultRunner
+	t.Cleanup(func() {
+		defaultRunner, kubeconfigFiles, namespaceCacheScope = saved, "", ""
+		kubeconfigOnce, kConfigOnce = sync.Once{}, sync.Once{}
+		loadedKubeconfig, loadedKConfig = nil, nil
+	})
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"+"}, "+prod\n+stage\n:6\n"},
+		{[]string{"@"}, "@prod-cluster\n:6\n"},
+		{[]string{"@prod-cluster:s"}, "@prod-cluster:stage-web\n:4\n"},
+		{[]string{"get", ":s"}, ":stage-web\n:4\n"},
+	}
+	for _, tt := range tests {
+		kubeconfigOnce, kConfigOnce = sync.Once{}, sync.Once{}
+		var buf bytes.Buffer
+		runComplete(tt.args, &buf)
+		if buf.String() != tt.want {
+			t.Errorf("k __complete %q = %q, want %q", tt.args, buf.String(), tt.want)
+		}
+	}
+	data, _ := os.ReadFile(calls)
+	if strings.Contains(string(data), "config view") {
+		t.Errorf("k __complete ran kubectl config view:\n%s", data)
+	}
+}
+
+func TestCompleteWithKubectl(t *testing.T) {
+	useCompletionConfigs(t)
+	runner := fakeKubectl(t, "echo \"$@\"\necho :4\n")
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"get"}, "__complete get po\n:4\n"},
+		{[]string{"@stage-cluster:web", "--k-retries", "2", "get"}, "__complete get --context stage --namespace web po\n:4\n"},
+		{[]string{"+prod:team-*", "+stage", "get"}, "__complete get --context prod po\n:4\n"},
+		{[]string{"exec", "pod", "--", "ls"}, "__complete exec pod -- ls po\n:4\n"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		complete(runner, tt.args, "po", envDefaults{}, &buf)
+		if buf.String() != tt.want {
+			t.Errorf("complete(%q) = %q, want %q", tt.args, buf.String(), tt.want)
+		}
+	}
+}
+
+func TestRunCompletion(t *testing.T) {
+	for shell := range completionScripts {
+		var buf bytes.Buffer
+		if code := runCompletion([]string{shell}, &buf); code != 0 || !strings.Contains(buf.String(), "__complete") {
+			t.Errorf("k completion %s = %d, %q", shell, code, buf.String())
+		}
+	}
+
+	saved := logger
+	defer func() { logger = saved }()
+	var stderr bytes.Buffer
+	logger = newLogger(&stderr, "", slog.LevelInfo)
+	if code := runCompletion([]string{"tcsh"}, &bytes.Buffer{}); code != 1 || !strings.Contains(stderr.String(), "usage") {
+		t.Errorf("k completion tcsh = %d, %q, want usage", code, stderr.String())
 	}
 }
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rothgar/k/pkg/kspace"
+)
+
+// namespaceCacheTTL is how long listed namespaces are trusted
+const namespaceCacheTTL = 5 * time.Minute
+
+// namespaceCacheEntry is the cached list of namespaces for one context
+type namespaceCacheEntry struct {
+	Fetched    time.Time `json:"fetched"`
+	Namespaces []string  `json:"namespaces"`
+}
+
+var namespaceCacheMu sync.Mutex
+
+// namespaceCacheSince is when k started. Namespaces listed since then are
+// fresh enough to say a namespace doesn't exist.
+var namespaceCacheSince = time.Now()
+
+// namespaceCacheScope keeps cached namespaces of different kubeconfigs
+// apart, since context names like kind-kind are reused between them
+var namespaceCacheScope string
+
+// setNamespaceCacheScope scopes the namespace cache to the kubeconfig
+// kubectl reads: --kubeconfig when it's passed or else KUBECONFIG
+func setNamespaceCacheScope(parsed kubectlArgs, kubeconfig string) {
+	if flag, ok := parsed.value("kubeconfig"); ok {
+		kubeconfig = flag
+	}
+	namespaceCacheScope = kubeconfig
+}
+
+// namespaceCachePath returns where listed namespaces are cached
+func namespaceCachePath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "k", "namespaces.json")
+}
+
+func readNamespaceCache() map[string]namespaceCacheEntry {
+	cache := make(map[string]namespaceCacheEntry)
+	p := namespaceCachePath()
+	if p == "" {
+		return cache
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return cache
+	}
+	json.Unmarshal(data, &cache)
+	return cache
+}
+
+func writeNamespaceCache(cache map[string]namespaceCacheEntry) {
+	p := namespaceCachePath()
+	if p == "" {
+		return
+	}
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+		return
+	}
+	os.WriteFile(p, data, 0o600)
+}
+
+// namespaceLister returns a function listing namespaces with the kubectl,
+// environment and tunnel the k config sets for each context, so namespace
+// checks get the same AWS_PROFILE or proxy as the command itself
+func namespaceLister(base kubectlRunner) func(context string, selector string, fresh bool) ([]string, error) {
+	return func(context string, selector string, fresh bool) ([]string, error) {
+		r, err := runnerForContext(base, context)
+		if err != nil {
+			return nil, err
+		}
+		return listNamespaces(r, context, selector, fresh)
+	}
+}
+
+// listNamespaces returns the namespaces in context matching the label
+// selector, using the cache when it is fresh. When fresh is true only
+// namespaces listed since k started are used from the cache. An empty
+// context uses the current context and an empty selector lists all
+// namespaces.
+func listNamespaces(r Runner, context string, selector string, fresh bool) ([]string, error) {
+	key := context
+	if key == "" {
+		if kc, err := loadKubeconfig(); err == nil {
+			key = kc.CurrentContext
+		}
+	}
+	cacheKey := key
+	if selector != "" {
+		cacheKey += "{" + selector + "}"
+	}
+	if namespaceCacheScope != "" {
+		sum := sha256.Sum256([]byte(namespaceCacheScope))
+		cacheKey = hex.EncodeToString(sum[:8]) + "/" + cacheKey
+	}
+
+	namespaceCacheMu.Lock()
+	entry, ok := readNamespaceCache()[cacheKey]
+	namespaceCacheMu.Unlock()
+	if ok && time.Since(entry.Fetched) < namespaceCacheTTL && (!fresh || !entry.Fetched.Before(namespaceCacheSince)) {
+		return entry.Namespaces, nil
+	}
+
+	args := []string{"get", "namespaces", "--output", "name"}
+	if selector != "" {
+		args = append(args, "--selector", selector)
+	}
+	if context != "" {
+		args = append(args, "--context", context)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := r.Command(args)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("listing namespaces in %q: %s", key, strings.TrimSpace(stderr.String()))
+	}
+
+	var namespaces []string
+	for _, line := range strings.Fields(stdout.String()) {
+		namespaces = append(namespaces, strings.TrimPrefix(line, "namespace/"))
+	}
+
+	namespaceCacheMu.Lock()
+	cache := readNamespaceCache()
+	cache[cacheKey] = namespaceCacheEntry{Fetched: time.Now(), Namespaces: namespaces}
+	writeNamespaceCache(cache)
+	namespaceCacheMu.Unlock()
+
+	return namespaces, nil
+}
+
+// isNamespaceGlob checks if a namespace is a pattern like team-* rather
+// than a name. A lone * still means all namespaces.
+func isNamespaceGlob(ns string) bool {
+	return ns != kspace.AllNamespaces && !isNamespaceSelector(ns) && strings.ContainsAny(ns, "*?[")
+}
+
+// isNamespaceSelector checks if a namespace is a label selector like
+// {team=payments} which selects namespaces by their labels
+func isNamespaceSelector(ns string) bool {
+	return len(ns) > 2 && strings.HasPrefix(ns, "{") && strings.HasSuffix(ns, "}")
+}
+
+// namespaceQuery is a single call to list namespaces
+type namespaceQuery struct {
+	context  string
+	selector string
+}
+
+// matchNamespaces returns the namespaces a kspace namespace, selector or
+// glob matches among the listed namespaces
+func matchNamespaces(ns string, namespaces []string) []string {
+	switch {
+	case isNamespaceSelector(ns):
+		return namespaces
+	case isNamespaceGlob(ns):
+		var matches []string
+		for _, listed := range namespaces {
+			if ok, _ := path.Match(ns, listed); ok {
+				matches = append(matches, listed)
+			}
+		}
+		return matches
+	}
+	if _, found := sliceFind(namespaces, ns); found {
+		return []string{ns}
+	}
+	return nil
+}
+
+// resolveNamespaces expands label selectors and globs into one target per
+// matching namespace in each target. When validate is true namespace names
+// are also checked against the namespaces that exist in their target.
+// Namespaces are listed in the context kubectl will use for each target,
+// so --context in args and KUBE_CONTEXT count. listFn is used to list
+// namespaces for a context and label selector, bypassing older cached
+// lists when fresh is true.
+func resolveNamespaces(clusters map[string]Target, args []string, env envDefaults, validate bool, listFn func(context string, selector string, fresh bool) ([]string, error)) (map[string]Target, []string, error) {
+	// the query listing the namespaces of a target, if it needs one
+	query := func(c Target) (namespaceQuery, bool) {
+		switch {
+		case isNamespaceSelector(c.namespace):
+			return namespaceQuery{targetContext(args, c, env), strings.Trim(c.namespace, "{}")}, true
+		case validate && c.namespace != "" && c.namespace != kspace.AllNamespaces:
+			return namespaceQuery{targetContext(args, c, env), ""}, true
+		}
+		return namespaceQuery{}, false
+	}
+
+	listed := make(map[namespaceQuery][]string)
+	listErrs := make(map[namespaceQuery]error)
+	// list namespaces once per context and selector, in parallel
+	listAll := func(queries map[namespaceQuery]bool, fresh bool) {
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for q := range queries {
+			wg.Add(1)
+			go func(q namespaceQuery) {
+				defer wg.Done()
+				namespaces, err := listFn(q.context, q.selector, fresh)
+				mu.Lock()
+				defer mu.Unlock()
+				listed[q] = namespaces
+				listErrs[q] = err
+			}(q)
+		}
+		wg.Wait()
+	}
+
+	queries := make(map[namespaceQuery]bool)
+	for _, c := range clusters {
+		if q, ok := query(c); ok {
+			queries[q] = true
+		}
+	}
+	listAll(queries, false)
+
+	// a cached list may be older than the namespace, so list again before
+	// saying it doesn't exist
+	stale := make(map[namespaceQuery]bool)
+	for _, c := range clusters {
+		if q, ok := query(c); ok && listErrs[q] == nil && len(matchNamespaces(c.namespace, listed[q])) == 0 {
+			stale[q] = true
+		}
+	}
+	listAll(stale, true)
+
+	resolved := make(map[string]Target)
+	// expand replaces the target with one target per namespace
+	expand := func(name string, c Target, namespaces []string) {
+		for _, ns := range namespaces {
+			expanded := c
+			expanded.namespace = ns
+			resolved[strings.TrimSuffix(name, c.namespace)+ns] = expanded
+		}
+	}
+
+	var errs []string
+	for _, name := range sortedCopy(mapKeys(clusters)) {
+		c := clusters[name]
+		q, ok := query(c)
+		if !ok {
+			resolved[name] = c
+			continue
+		}
+
+		matches := matchNamespaces(c.namespace, listed[q])
+		switch {
+		case isNamespaceSelector(c.namespace):
+			if err := listErrs[q]; err != nil {
+				errs = append(errs, fmt.Sprintf("%s: can't select namespaces: %v", name, err))
+			} else if len(matches) == 0 {
+				errs = append(errs, fmt.Sprintf("%s: no namespaces match labels %s", name, q.selector))
+			} else {
+				expand(name, c, matches)
+			}
+
+		case isNamespaceGlob(c.namespace):
+			if err := listErrs[q]; err != nil {
+				errs = append(errs, fmt.Sprintf("%s: can't expand %q: %v", name, c.namespace, err))
+			} else if len(matches) == 0 {
+				errs = append(errs, fmt.Sprintf("%s: no namespaces match %q", name, c.namespace))
+			} else {
+				expand(name, c, matches)
+			}
+
+		case listErrs[q] != nil:
+			// we may not be allowed to list namespaces, let kubectl decide
+			resolved[name] = c
+
+		case len(matches) == 0:
+			msg := fmt.Sprintf("%s: namespace %q not found", name, c.namespace)
+			if suggestions := suggestNames(c.namespace, listed[q]); len(suggestions) > 0 {
+				msg += ", did you mean " + strings.Join(suggestions, " or ") + "?"
+			}
+			errs = append(errs, msg)
+
+		default:
+			resolved[name] = c
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, nil, fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
+	return resolved, sortedCopy(mapKeys(resolved)), nil
+}
+
+// defaultNamespaces labels targets that don't set a namespace with the
+// namespace kubectl will use: a --namespace flag in args or KUBE_NAMESPACE,
+// or else the namespace of the target's context in kubeconfig, or else
+// "default". Targets are renamed to include it, e.g. +prod becomes
+// +prod:monitoring. A --namespace flag also beats the kspace's namespace,
+// so +prod:web is relabeled too, and targets that end up the same are
+// only run once.
+func defaultNamespaces(clusters map[string]Target, args []string, env envDefaults, kc *kubeconfig) (map[string]Target, []string) {
+	parsed := parseKubectlArgs(args)
+	if parsed.enabled("all-namespaces") {
+		return clusters, sortedCopy(mapKeys(clusters))
+	}
+	flagNamespace, fromFlag := parsed.value("namespace")
+	if !fromFlag {
+		flagNamespace = env.namespace
+	}
+
+	contextNamespaces := make(map[string]string)
+	for _, ctx := range kc.Contexts {
+		contextNamespaces[ctx.Name] = ctx.Context.Namespace
+	}
+
+	labeled := make(map[string]Target)
+	for name, c := range clusters {
+		if c.namespace != "" && fromFlag {
+			c.effectiveNamespace = flagNamespace
+			labeled[strings.TrimSuffix(name, ":"+c.namespace)+":"+flagNamespace] = c
+			continue
+		}
+		if c.namespace != "" {
+			labeled[name] = c
+			continue
+		}
+		context := c.context
+		if context == "" {
+			context = env.context
+		}
+		if context == "" {
+			context = kc.CurrentContext
+		}
+		c.effectiveNamespace = flagNamespace
+		if c.effectiveNamespace == "" {
+			c.effectiveNamespace = contextNamespaces[context]
+		}
+		if c.effectiveNamespace == "" {
+			c.effectiveNamespace = "default"
+		}
+		labeled[name+":"+c.effectiveNamespace] = c
+	}
+	return labeled, sortedCopy(mapKeys(labeled))
+}
+
+// suggestNames returns up to three names close to s
+func suggestNames(s string, names []string) []string {
+	type candidate struct {
+		name     string
+		distance int
+	}
+	var candidates []candidate
+	limit := max(2, len(s)/3)
+	for _, name := range names {
+		d := levenshtein(s, name)
+		if d <= limit || (len(s) > 2 && strings.HasPrefix(name, s)) {
+			candidates = append(candidates, candidate{name, d})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].distance < candidates[j].distance
+	})
+
+	var suggestions []string
+	for i := 0; i < len(candidates) && i < 3; i++ {
+		suggestions = append(suggestions, candidates[i].name)
+	}
+	return suggestions
+}
+
+// levenshtein returns the edit distance between a and b
+func levenshtein(a string, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// mapKeys returns the keys of a map of clusters
+func mapKeys(m map[string]Target) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
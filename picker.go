@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/mattn/go-isatty"
+)
+
+// pickerHeight is the maximum number of choices shown at once
+const pickerHeight = 10
+
+var errPickerCanceled = errors.New("selection canceled")
+
+// picker is a filterable multi-select list. It only holds state so it can be
+// driven by keys from a terminal or from tests.
+type picker struct {
+	prompt   string
+	choices  []string
+	filter   string
+	cursor   int
+	offset   int
+	selected map[string]bool
+	done     bool
+	canceled bool
+}
+
+func newPicker(prompt string, choices []string) *picker {
+	return &picker{
+		prompt:   prompt,
+		choices:  choices,
+		selected: make(map[string]bool),
+	}
+}
+
+// fuzzyMatch reports whether all characters of pattern appear in s in order
+func fuzzyMatch(pattern string, s string) bool {
+	s = strings.ToLower(s)
+	for _, r := range strings.ToLower(pattern) {
+		i := strings.IndexRune(s, r)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(string(r)):]
+	}
+	return true
+}
+
+// visible returns the choices matching the current filter
+func (p *picker) visible() []string {
+	var matches []string
+	for _, c := range p.choices {
+		if fuzzyMatch(p.filter, c) {
+			matches = append(matches, c)
+		}
+	}
+	return matches
+}
+
+// handleKey updates the picker for a single key press read from a raw terminal
+func (p *picker) handleKey(key string) {
+	matches := p.visible()
+	switch key {
+	case "\r", "\n":
+		p.done = true
+		if len(p.selected) == 0 && p.cursor < len(matches) {
+			p.selected[matches[p.cursor]] = true
+		}
+	case "\x03", "\x1b":
+		// ctrl-c or escape
+		p.done = true
+		p.canceled = true
+	case "\t", " ":
+		if p.cursor < len(matches) {
+			c := matches[p.cursor]
+			p.selected[c] = !p.selected[c]
+			if !p.selected[c] {
+				delete(p.selected, c)
+			}
+		}
+	case "\x1b[A", "\x10":
+		// up or ctrl-p
+		if p.cursor > 0 {
+			p.cursor--
+		}
+	case "\x1b[B", "\x0e":
+		// down or ctrl-n
+		if p.cursor < len(matches)-1 {
+			p.cursor++
+		}
+	case "\x7f", "\x08":
+		if p.filter != "" {
+			p.filter = p.filter[:len(p.filter)-1]
+			p.cursor = 0
+		}
+	default:
+		if len(key) == 1 && key[0] >= ' ' && key[0] < 0x7f {
+			p.filter += key
+			p.cursor = 0
+		}
+	}
+
+	// keep the cursor on screen
+	if p.cursor < p.offset {
+		p.offset = p.cursor
+	}
+	if p.cursor >= p.offset+pickerHeight {
+		p.offset = p.cursor - pickerHeight + 1
+	}
+}
+
+// result returns the selected choices in their original order
+func (p *picker) result() []string {
+	var picked []string
+	for _, c := range p.choices {
+		if p.selected[c] {
+			picked = append(picked, c)
+		}
+	}
+	return picked
+}
+
+// render draws the picker and returns the number of lines written
+func (p *picker) render(w io.Writer) int {
+	matches := p.visible()
+	lines := []string{fmt.Sprintf("%s> %s", p.prompt, p.filter)}
+	end := min(p.offset+pickerHeight, len(matches))
+	for i := p.offset; i < end; i++ {
+		cursor := "  "
+		if i == p.cursor {
+			cursor = "> "
+		}
+		mark := "[ ]"
+		if p.selected[matches[i]] {
+			mark = "[x]"
+		}
+		lines = append(lines, fmt.Sprintf("%s%s %s", cursor, mark, matches[i]))
+	}
+	lines = append(lines, fmt.Sprintf("  %d/%d  tab: select  enter: run  esc: cancel", len(matches), len(p.choices)))
+
+	fmt.Fprint(w, "\r\033[J"+strings.Join(lines, "\r\n"))
+	return len(lines)
+}
+
+// pickTargets asks the user to choose one or more names on the terminal
+func pickTargets(prompt string, choices []string) ([]string, error) {
+	if !isatty.IsTerminal(os.Stdin.Fd()) {
+		return nil, fmt.Errorf("%s needs a name when stdin is not a terminal", prompt)
+	}
+	if len(choices) == 0 {
+		return nil, fmt.Errorf("no choices found for %s in kubeconfig", prompt)
+	}
+
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("opening terminal: %w", err)
+	}
+	defer tty.Close()
+
+	restore, err := rawTerminal(tty)
+	if err != nil {
+		return nil, err
+	}
+	defer restore()
+
+	p := newPicker(prompt, choices)
+	buf := make([]byte, 16)
+	height := p.render(tty)
+	for !p.done {
+		n, err := tty.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		p.handleKey(string(buf[:n]))
+		// move back to the first line before drawing again
+		if height > 1 {
+			fmt.Fprintf(tty, "\033[%dA", height-1)
+		}
+		height = p.render(tty)
+	}
+
+	// clear the picker from the screen
+	if height > 1 {
+		fmt.Fprintf(tty, "\033[%dA", height-1)
+	}
+	fmt.Fprint(tty, "\r\033[J")
+
+	if p.canceled {
+		return nil, errPickerCanceled
+	}
+	return p.result(), nil
+}
+
+// rawTerminal puts tty into raw mode with stty and returns a function that
+// restores the previous settings
+func rawTerminal(tty *os.File) (func(), error) {
+	stty := func(args ...string) (string, error) {
+		cmd := exec.Command("stty", args...)
+		cmd.Stdin = tty
+		out, err := cmd.Output()
+		return strings.TrimSpace(string(out)), err
+	}
+
+	state, err := stty("-g")
+	if err != nil {
+		return nil, fmt.Errorf("reading terminal settings: %w", err)
+	}
+	if _, err := stty("raw", "-echo"); err != nil {
+		return nil, fmt.Errorf("setting terminal to raw mode: %w", err)
+	}
+	return func() {
+		stty(state)
+	}, nil
+}
+
+// isIncompleteKspace checks if a kspace is a bare + or @ (optionally
+// followed by :namespace) which means the user wants to pick from a list
+func isIncompleteKspace(kspace string) bool {
+	return len(kspace) > 0 &&
+		(kspace[0] == '+' || kspace[0] == '@') &&
+		(len(kspace) == 1 || kspace[1] == ':')
+}
+
+// completeKspace replaces the missing context or cluster names in kspace with
+// the names picked by the user
+func completeKspace(kspace string) (string, error) {
+	kc, err := loadKubeconfig()
+	if err != nil {
+		return "", err
+	}
+
+	prefix, rest := kspace[:1], kspace[1:]
+	choices := kc.contextNames()
+	prompt := "+context"
+	if prefix == "@" {
+		choices = kc.clusterNames()
+		prompt = "@cluster"
+	}
+
+	picked, err := pickTargets(prompt, choices)
+	if err != nil {
+		return "", err
+	}
+	if len(picked) == 0 {
+		return "", errPickerCanceled
+	}
+	return prefix + strings.Join(picked, ",") + rest, nil
+}
@@ -0,0 +1,174 @@
+// Package kspace parses the target syntax of k, the kubectl wrapper, so
+// other tools can accept the same targets people type on the command line.
+//
+// A kspace selects where a kubectl command runs:
+//
+//	+context[,context...][:namespace[,namespace...]]
+//	@cluster[,cluster...][:namespace[,namespace...]]
+//	:namespace[,namespace...]
+//
+// Every combination of the listed contexts (or clusters) and namespaces is
+// a separate Target, so +prod,stage:web,api is four targets. The namespace
+// * means all namespaces. A @cluster is run with the first context in
+// kubeconfig that uses the cluster, see Kubeconfig.Resolve.
+//
+// Tag selectors (+[env=prod]), context globs and namespace label selectors
+// depend on k's config file or a live cluster and are expanded by k itself
+// before parsing. Parse passes namespace globs and selectors through as
+// they are.
+//
+// Exported names in this package won't change in incompatible ways without
+// a new major version of k.
+package kspace
+
+import (
+	"fmt"
+	"strings"
+)
+
+// prefixes are the characters a kspace starts with
+const prefixes = "+@:"
+
+// Prefixes returns the characters a kspace starts with
+func Prefixes() []string {
+	return strings.Split(prefixes, "")
+}
+
+// AllNamespaces is the namespace of a target that runs in every namespace
+const AllNamespaces = "*"
+
+// Target is one place a kubectl command runs
+type Target struct {
+	// Name is the kspace of just this target, e.g. "+prod:web" for one of
+	// the targets of "+prod,stage:web". k prefixes output with it.
+	Name string
+	// Context is the kubeconfig context. It's empty for @cluster targets
+	// until they're resolved, and for :namespace targets which use the
+	// current context.
+	Context string
+	// Cluster is the kubeconfig cluster of a @cluster target
+	Cluster string
+	// Namespace is empty for the context's default namespace
+	Namespace string
+}
+
+// Flags returns the kubectl flags that run a command in the target
+func (t Target) Flags() []string {
+	var flags []string
+	if t.Context != "" {
+		flags = append(flags, "--context", t.Context)
+	}
+	switch t.Namespace {
+	case "":
+	case AllNamespaces:
+		flags = append(flags, "--all-namespaces")
+	default:
+		flags = append(flags, "--namespace", t.Namespace)
+	}
+	return flags
+}
+
+// IsKspace checks if arg is a kspace rather than a kubectl argument
+func IsKspace(arg string) bool {
+	return arg != "" && strings.IndexByte(prefixes, arg[0]) >= 0
+}
+
+// Parse parses one kspace into its targets
+func Parse(kspace string) ([]Target, error) {
+	if !IsKspace(kspace) {
+		return nil, fmt.Errorf("kspace %q must start with +, @ or :", kspace)
+	}
+	prefix := kspace[:1]
+	names, namespacePart, _ := strings.Cut(kspace[1:], ":")
+	namespaces := nonEmpty(splitList(namespacePart))
+
+	if prefix == ":" {
+		// :ns has no names, so everything after the colon is namespaces
+		namespaces = nonEmpty(splitList(kspace[1:]))
+		if len(namespaces) == 0 {
+			return nil, fmt.Errorf("kspace %q has no namespace", kspace)
+		}
+		var targets []Target
+		for _, ns := range namespaces {
+			targets = append(targets, Target{Name: ":" + ns, Namespace: ns})
+		}
+		return targets, nil
+	}
+
+	list := nonEmpty(strings.Split(names, ","))
+	if len(list) == 0 {
+		return nil, fmt.Errorf("kspace %q has no context or cluster", kspace)
+	}
+	var targets []Target
+	for _, name := range list {
+		t := Target{Name: prefix + name}
+		if prefix == "+" {
+			t.Context = name
+		} else {
+			t.Cluster = name
+		}
+		if len(namespaces) == 0 {
+			targets = append(targets, t)
+			continue
+		}
+		for _, ns := range namespaces {
+			withNamespace := t
+			withNamespace.Name = t.Name + ":" + ns
+			withNamespace.Namespace = ns
+			targets = append(targets, withNamespace)
+		}
+	}
+	return targets, nil
+}
+
+// ParseAll parses kspaces and returns their targets in order. A target
+// selected by more than one kspace is only returned once.
+func ParseAll(kspaces []string) ([]Target, error) {
+	var targets []Target
+	seen := make(map[string]bool)
+	for _, kspace := range kspaces {
+		parsed, err := Parse(kspace)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range parsed {
+			if !seen[t.Name] {
+				seen[t.Name] = true
+				targets = append(targets, t)
+			}
+		}
+	}
+	return targets, nil
+}
+
+// splitList splits a comma separated list of namespaces. Commas inside
+// {label selectors} don't split.
+func splitList(s string) []string {
+	var list []string
+	depth, start := 0, 0
+	for i, r := range s {
+		switch r {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				list = append(list, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(list, s[start:])
+}
+
+// nonEmpty drops empty strings from list
+func nonEmpty(list []string) []string {
+	var kept []string
+	for _, s := range list {
+		if s != "" {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
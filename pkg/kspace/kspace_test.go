@@ -0,0 +1,269 @@
+package kspace
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		kspace string
+		want   []Target
+	}{
+		{"+prod", []Target{{Name: "+prod", Context: "prod"}}},
+		{"+prod,stage:web", []Target{
+			{Name: "+prod:web", Context: "prod", Namespace: "web"},
+			{Name: "+stage:web", Context: "stage", Namespace: "web"},
+		}},
+		{"@prod:web,api", []Target{
+			{Name: "@prod:web", Cluster: "prod", Namespace: "web"},
+			{Name: "@prod:api", Cluster: "prod", Namespace: "api"},
+		}},
+		{":default,kube-system", []Target{
+			{Name: ":default", Namespace: "default"},
+			{Name: ":kube-system", Namespace: "kube-system"},
+		}},
+		{"+admin@prod:*", []Target{{Name: "+admin@prod:*", Context: "admin@prod", Namespace: "*"}}},
+		{"+prod:{team=a,env=prod}", []Target{{Name: "+prod:{team=a,env=prod}", Context: "prod", Namespace: "{team=a,env=prod}"}}},
+		{"+prod:", []Target{{Name: "+prod", Context: "prod"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kspace, func(t *testing.T) {
+			got, err := Parse(tt.kspace)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("Parse(%s) = %+v, want %+v", tt.kspace, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, kspace := range []string{"prod", "+", "+:web", ":", "@,"} {
+		if targets, err := Parse(kspace); err == nil {
+			t.Errorf("Parse(%q) = %+v, want an error", kspace, targets)
+		}
+	}
+}
+
+func TestIsKspace(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want bool
+	}{
+		{"@cluster", true},
+		{"+context", true},
+		{":namespace", true},
+		{"get", false},
+		{"", false},
+		{"-n", false},
+	}
+	for _, tt := range tests {
+		if got := IsKspace(tt.arg); got != tt.want {
+			t.Errorf("IsKspace(%q) = %v, want %v", tt.arg, got, tt.want)
+		}
+	}
+
+	// callers can't change what counts as a kspace
+	Prefixes()[0] = "-"
+	if IsKspace("-n") || !IsKspace("+context") {
+		t.Errorf("changing Prefixes() changed IsKspace, Prefixes() = %q", Prefixes())
+	}
+}
+
+func TestContextForCluster(t *testing.T) {
+	kc := &Kubeconfig{Contexts: []Context{
+		{Name: "prod-admin", Cluster: "prod"},
+		{Name: "prod-eu-admin", Cluster: "prod-eu"},
+		{Name: "no-cluster"},
+	}}
+	tests := []struct {
+		cluster string
+		want    string
+		found   bool
+	}{
+		{"prod", "prod-admin", true},
+		// an exact match beats prod matching part of prod-eu
+		{"prod-eu", "prod-eu-admin", true},
+		// names containing a cluster's name find it, as they always have
+		{"prod-us", "prod-admin", true},
+		// but part of a cluster's name doesn't
+		{"pro", "", false},
+		{"stage", "", false},
+	}
+	for _, tt := range tests {
+		got, found := kc.ContextForCluster(tt.cluster)
+		if got != tt.want || found != tt.found {
+			t.Errorf("ContextForCluster(%q) = %q, %v, want %q, %v", tt.cluster, got, found, tt.want, tt.found)
+		}
+	}
+}
+
+func TestParseAll(t *testing.T) {
+	targets, err := ParseAll([]string{"+prod,stage", "+stage", ":web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, target := range targets {
+		names = append(names, target.Name)
+	}
+	if got := strings.Join(names, " "); got != "+prod +stage :web" {
+		t.Errorf("ParseAll() names = %q", got)
+	}
+}
+
+func TestFlags(t *testing.T) {
+	tests := []struct {
+		target Target
+		want   string
+	}{
+		{Target{Context: "prod", Namespace: "web"}, "--context prod --namespace web"},
+		{Target{Context: "prod", Namespace: AllNamespaces}, "--context prod --all-namespaces"},
+		{Target{Namespace: "web"}, "--namespace web"},
+		{Target{}, ""},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(tt.target.Flags(), " "); got != tt.want {
+			t.Errorf("%+v.Flags() = %q, want %q", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []string
+	}{
+		{"default", []string{"default"}},
+		{"default,kube-system", []string{"default", "kube-system"}},
+		{"{team=a,env=prod},default", []string{"{team=a,env=prod}", "default"}},
+		{"", []string{""}},
+	}
+
+	for _, tt := range tests {
+		got := splitList(tt.s)
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("splitList(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+// writeFiles creates files with their contents below dir
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, data := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestKubeconfigFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"config":                   "",
+		"eksctl/clusters/cluster1": "",
+		"kind":                     "",
+		"cache/discovery/x.json":   "",
+		"http-cache/abc":           "",
+		"kubens/prod":              "",
+		"kubectx":                  "",
+		"kind.lock":                "",
+		"eksctl/clusters/config":   "",
+	})
+
+	files, err := KubeconfigFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		filepath.Join(dir, "config"),
+		filepath.Join(dir, "eksctl/clusters/cluster1"),
+		filepath.Join(dir, "kind"),
+	}
+	if strings.Join(files, " ") != strings.Join(want, " ") {
+		t.Errorf("KubeconfigFiles() = %q, want %q", files, want)
+	}
+
+	files, err = KubeconfigFiles(filepath.Join(dir, "missing"))
+	if err != nil || len(files) != 0 {
+		t.Errorf("KubeconfigFiles(missing) = %q, %v, want nothing", files, err)
+	}
+}
+
+func TestLoadKubeconfig(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a": `current-context: prod-admin
+contexts:
+- name: prod-admin
+  context: {cluster: prod, namespace: web}
+`,
+		"b": `current-context: stage-admin
+contexts:
+- name: prod-admin
+  context: {cluster: other}
+- name: prod-readonly
+  context: {cluster: prod}
+- name: stage-admin
+  context: {cluster: stage}
+`,
+	})
+	kubeconfig := strings.Join([]string{filepath.Join(dir, "a"), filepath.Join(dir, "missing"), filepath.Join(dir, "b")}, string(filepath.ListSeparator))
+
+	kc, err := LoadKubeconfig(kubeconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kc.CurrentContext != "prod-admin" {
+		t.Errorf("CurrentContext = %q, want the first file's", kc.CurrentContext)
+	}
+	want := []Context{
+		{Name: "prod-admin", Cluster: "prod", Namespace: "web"},
+		{Name: "prod-readonly", Cluster: "prod"},
+		{Name: "stage-admin", Cluster: "stage"},
+	}
+	if fmt.Sprint(kc.Contexts) != fmt.Sprint(want) {
+		t.Errorf("Contexts = %+v, want %+v", kc.Contexts, want)
+	}
+
+	targets, err := ParseAll([]string{"@prod,stage:web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolved, err := kc.Resolve(targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved[0].Context != "prod-admin" || resolved[1].Context != "stage-admin" {
+		t.Errorf("Resolve() = %+v", resolved)
+	}
+
+	missing, _ := Parse("@dev")
+	if _, err := kc.Resolve(missing); err == nil {
+		t.Error("Resolve(@dev) should fail without a context for the cluster")
+	}
+}
+
+func ExampleParse() {
+	targets, err := Parse("+prod,stage:web")
+	if err != nil {
+		panic(err)
+	}
+	for _, t := range targets {
+		fmt.Println(t.Name, t.Flags())
+	}
+	// Output:
+	// +prod:web [--context prod --namespace web]
+	// +stage:web [--context stage --namespace web]
+}
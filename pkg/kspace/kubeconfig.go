@@ -0,0 +1,159 @@
+package kspace
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// skippedDirs hold caches and tool state rather than kubeconfig files
+var skippedDirs = []string{"cache", "http-cache", "kubens"}
+
+// KubeconfigFiles returns the kubeconfig files k uses when KUBECONFIG isn't
+// set: dir/config first, then every other file below dir. Caches, lock
+// files and kubectx state are skipped. A missing dir has no files.
+func KubeconfigFiles(dir string) ([]string, error) {
+	var files []string
+	defaultConfig := filepath.Join(dir, "config")
+	if info, err := os.Stat(defaultConfig); err == nil && !info.IsDir() {
+		files = append(files, defaultConfig)
+	}
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			for _, skipped := range skippedDirs {
+				if d.Name() == skipped {
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		}
+		if d.Name() == "kubectx" || d.Name() == "config" || strings.Contains(d.Name(), ".lock") {
+			return nil
+		}
+		files = append(files, path)
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) && len(files) == 0 {
+		return nil, nil
+	}
+	return files, err
+}
+
+// DefaultKubeconfig returns KUBECONFIG, or when it isn't set the files
+// from KubeconfigFiles in ~/.kube as a KUBECONFIG path list
+func DefaultKubeconfig() (string, error) {
+	if kubeconfig, ok := os.LookupEnv("KUBECONFIG"); ok {
+		return kubeconfig, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	files, err := KubeconfigFiles(filepath.Join(home, ".kube"))
+	return strings.Join(files, string(filepath.ListSeparator)), err
+}
+
+// Context is a kubeconfig context
+type Context struct {
+	Name      string
+	Cluster   string
+	Namespace string
+}
+
+// Kubeconfig is the part of a kubeconfig needed to resolve targets
+type Kubeconfig struct {
+	CurrentContext string
+	Contexts       []Context
+}
+
+// LoadKubeconfig reads the files in a KUBECONFIG path list. Like kubectl,
+// the first file to set the current context or define a context wins and
+// missing files are skipped.
+func LoadKubeconfig(kubeconfig string) (*Kubeconfig, error) {
+	kc := &Kubeconfig{}
+	seen := make(map[string]bool)
+	for _, p := range filepath.SplitList(kubeconfig) {
+		if p == "" {
+			continue
+		}
+		data, err := os.ReadFile(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		var file struct {
+			CurrentContext string `yaml:"current-context"`
+			Contexts       []struct {
+				Name    string `yaml:"name"`
+				Context struct {
+					Cluster   string `yaml:"cluster"`
+					Namespace string `yaml:"namespace"`
+				} `yaml:"context"`
+			} `yaml:"contexts"`
+		}
+		if err := yaml.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", p, err)
+		}
+		if kc.CurrentContext == "" {
+			kc.CurrentContext = file.CurrentContext
+		}
+		for _, c := range file.Contexts {
+			if seen[c.Name] {
+				continue
+			}
+			seen[c.Name] = true
+			kc.Contexts = append(kc.Contexts, Context{Name: c.Name, Cluster: c.Context.Cluster, Namespace: c.Context.Namespace})
+		}
+	}
+	return kc, nil
+}
+
+// ContextForCluster returns the first context that uses cluster. Like k
+// always has, it otherwise returns the first context whose cluster name, as
+// a regular expression, matches part of cluster, so @kind-dev finds the
+// context of cluster kind.
+func (kc *Kubeconfig) ContextForCluster(cluster string) (string, bool) {
+	for _, c := range kc.Contexts {
+		if c.Cluster == cluster {
+			return c.Name, true
+		}
+	}
+	for _, c := range kc.Contexts {
+		if c.Cluster == "" {
+			continue
+		}
+		if ok, _ := regexp.MatchString(c.Cluster, cluster); ok {
+			return c.Name, true
+		}
+	}
+	return "", false
+}
+
+// Resolve sets the context of @cluster targets and returns the targets.
+// It fails if a cluster isn't used by any context.
+func (kc *Kubeconfig) Resolve(targets []Target) ([]Target, error) {
+	resolved := make([]Target, len(targets))
+	for i, t := range targets {
+		if t.Cluster != "" && t.Context == "" {
+			context, ok := kc.ContextForCluster(t.Cluster)
+			if !ok {
+				return nil, fmt.Errorf("%s: no context found for cluster %s", t.Name, t.Cluster)
+			}
+			t.Context = context
+		}
+		resolved[i] = t
+	}
+	return resolved, nil
+}
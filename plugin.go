@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// pluginName is the binary name k uses when it's installed as a kubectl
+// plugin so `kubectl k +prod get pods` works
+const pluginName = "kubectl-k"
+
+// kubectlCommands are kubectl's built in commands. Plugins can't replace them.
+var kubectlCommands = []string{
+	"alpha", "annotate", "api-resources", "api-versions", "apply", "attach",
+	"auth", "autoscale", "certificate", "cluster-info", "completion", "config",
+	"cordon", "cp", "create", "debug", "delete", "describe", "diff", "drain",
+	"edit", "events", "exec", "explain", "expose", "get", "help", "kustomize",
+	"label", "logs", "options", "patch", "plugin", "port-forward", "proxy",
+	"replace", "rollout", "run", "scale", "set", "taint", "top", "uncordon",
+	"version", "wait",
+}
+
+// isPluginInvocation checks if k was run by kubectl as the kubectl-k plugin
+func isPluginInvocation() bool {
+	name := strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe")
+	return name == pluginName
+}
+
+// findKubectl returns the kubectl k runs: $K_KUBECTL if it's set or else
+// kubectl on PATH. Any kubectl that is really k (e.g. k symlinked or aliased
+// to kubectl) is skipped so k never runs itself.
+func findKubectl() (string, error) {
+	self, err := os.Executable()
+	if err == nil {
+		if resolved, err := filepath.EvalSymlinks(self); err == nil {
+			self = resolved
+		}
+	}
+
+	if binary := os.Getenv("K_KUBECTL"); binary != "" {
+		path, err := exec.LookPath(binary)
+		if err != nil {
+			return "", fmt.Errorf("K_KUBECTL: %w", err)
+		}
+		if self != "" && sameFile(path, self) {
+			return "", fmt.Errorf("K_KUBECTL: %s is k, not kubectl", path)
+		}
+		return path, nil
+	}
+
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		if dir == "" {
+			dir = "."
+		}
+		candidate, err := exec.LookPath(filepath.Join(dir, "kubectl"))
+		if err != nil {
+			continue
+		}
+		if self != "" && sameFile(candidate, self) {
+			continue
+		}
+		return candidate, nil
+	}
+	return "", errors.New("kubectl not found in PATH")
+}
+
+// sameFile checks if two paths point at the same file
+func sameFile(a string, b string) bool {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bInfo, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(aInfo, bInfo)
+}
+
+// findPlugin checks if args run a kubectl plugin and returns the plugin's
+// path and the arguments to pass it. Like kubectl, `foo bar` runs
+// kubectl-foo-bar if it exists and kubectl-foo otherwise.
+func findPlugin(args []string) (string, []string, bool) {
+	parsed := parseKubectlArgs(args)
+	if parsed.verb == "" || len(parsed.positional) == 0 {
+		return "", nil, false
+	}
+	if _, builtin := sliceFind(kubectlCommands, parsed.verb); builtin {
+		return "", nil, false
+	}
+	// k itself isn't a plugin for k
+	if parsed.verb == "k" {
+		return "", nil, false
+	}
+
+	// plugin names are made from consecutive positional arguments
+	first := parsed.positional[0]
+	var words []int
+	for i, idx := range parsed.positional {
+		if idx != first+i || strings.ContainsAny(args[idx], "=/") {
+			break
+		}
+		words = append(words, idx)
+	}
+
+	for n := len(words); n > 0; n-- {
+		var parts []string
+		for _, idx := range words[:n] {
+			parts = append(parts, strings.ReplaceAll(args[idx], "-", "_"))
+		}
+		path, err := exec.LookPath("kubectl-" + strings.Join(parts, "-"))
+		if err != nil {
+			continue
+		}
+		pluginArgs := append([]string{}, args[:first]...)
+		pluginArgs = append(pluginArgs, args[words[n-1]+1:]...)
+		return path, pluginArgs, true
+	}
+	return "", nil, false
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// portSpec matches kubectl port-forward ports: 8080, 8080:80 and :80
+var portSpec = regexp.MustCompile(`^(?:(\d*):)?(\d+)$`)
+
+// portMapping describes a single local port forwarded for a target
+type portMapping struct {
+	local  int
+	remote string
+}
+
+// isPortForwardCommand checks if the kubectl command is port-forward, with
+// or without flags before it
+func isPortForwardCommand(args []string) bool {
+	return parseKubectlArgs(args).verb == "port-forward"
+}
+
+// portForwardTargets rewrites the local ports of a port-forward command so
+// every target gets its own ports. Targets are numbered in sorted order.
+// Without a template the requested local port is used for the first target
+// and the next free ports for the following targets. A template like
+// "30{idx}" or "{port}{idx}" picks the local port explicitly.
+func portForwardTargets(args []string, names []string, template string) (map[string][]string, map[string][]portMapping, error) {
+	targetArgs := make(map[string][]string)
+	mappings := make(map[string][]portMapping)
+	used := make(map[int]bool)
+
+	sorted := sortedCopy(names)
+
+	// find the index of every port argument, they follow the verb and
+	// the resource
+	var ports []int
+	parsed := parseKubectlArgs(args)
+	if len(parsed.positional) > 2 {
+		for _, i := range parsed.positional[2:] {
+			if portSpec.MatchString(args[i]) {
+				ports = append(ports, i)
+			}
+		}
+	}
+
+	for idx, name := range sorted {
+		cmdArgs := make([]string, len(args))
+		copy(cmdArgs, args)
+
+		for _, i := range ports {
+			m := portSpec.FindStringSubmatch(args[i])
+			local, remote := m[1], m[2]
+			if local == "" && !strings.Contains(args[i], ":") {
+				local = remote
+			}
+			if local == "" {
+				// kubectl picks a random local port which can't conflict
+				mappings[name] = append(mappings[name], portMapping{remote: remote})
+				continue
+			}
+
+			port, err := allocateLocalPort(local, idx, template, used)
+			if err != nil {
+				return nil, nil, err
+			}
+			cmdArgs[i] = fmt.Sprintf("%d:%s", port, remote)
+			mappings[name] = append(mappings[name], portMapping{local: port, remote: remote})
+		}
+		targetArgs[name] = cmdArgs
+	}
+
+	return targetArgs, mappings, nil
+}
+
+// allocateLocalPort picks the local port for target idx
+func allocateLocalPort(requested string, idx int, template string, used map[int]bool) (int, error) {
+	if template != "" {
+		s := strings.ReplaceAll(template, "{idx}", strconv.Itoa(idx))
+		s = strings.ReplaceAll(s, "{port}", requested)
+		port, err := strconv.Atoi(s)
+		if err != nil || port < 1 || port > 65535 {
+			return 0, fmt.Errorf("port template %q gives invalid port %q", template, s)
+		}
+		if used[port] {
+			return 0, fmt.Errorf("port template %q gives port %d more than once", template, port)
+		}
+		used[port] = true
+		return port, nil
+	}
+
+	port, _ := strconv.Atoi(requested)
+	for ; port <= 65535; port++ {
+		if !used[port] && localPortFree(port) {
+			used[port] = true
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("no free local port found starting at %s", requested)
+}
+
+func localPortFree(port int) bool {
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
+
+// printPortMappings prints which local ports belong to which target
+func printPortMappings(w io.Writer, names []string, resource string, mappings map[string][]portMapping) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "KSPACE\tLOCAL\tREMOTE")
+	for _, name := range sortedCopy(names) {
+		for _, m := range mappings[name] {
+			local := "random"
+			if m.local != 0 {
+				local = fmt.Sprintf("127.0.0.1:%d", m.local)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s:%s\n", name, local, resource, m.remote)
+		}
+	}
+	tw.Flush()
+}
+
+// portForwardResource returns the TYPE/NAME argument of a port-forward command
+func portForwardResource(args []string) string {
+	parsed := parseKubectlArgs(args)
+	if len(parsed.positional) < 2 {
+		return ""
+	}
+	return args[parsed.positional[1]]
+}
+
+// maxPortForwardFailures is how many times in a row a port-forward can
+// exit without coming up before it's given up on
+const maxPortForwardFailures = 5
+
+// forwardWatcher notes when kubectl reports a port-forward is listening
+type forwardWatcher struct {
+	up atomic.Bool
+}
+
+func (f *forwardWatcher) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte("Forwarding from")) {
+		f.up.Store(true)
+	}
+	return len(p), nil
+}
+
+// superviseKubectl runs kubectl for kspace and starts it again whenever it
+// exits, backing off up to 30 seconds between attempts. It's used for
+// port-forwards which kubectl gives up on when a connection drops. A
+// forward that never came up (e.g. a typo in the resource) or keeps failing
+// is given up on and its exit code returned.
+func superviseKubectl(args []string, kspace string, r Runner) int {
+	backoff := time.Second
+	everUp := false
+	failures := 0
+	for {
+		started := time.Now()
+		kCmd := r.Command(args)
+
+		stdout, err := kCmd.StdoutPipe()
+		if err != nil {
+			logger.Error(err.Error(), "kspace", kspace)
+			return 1
+		}
+		stderr, err := kCmd.StderrPipe()
+		if err != nil {
+			logger.Error(err.Error(), "kspace", kspace)
+			return 1
+		}
+
+		var forward forwardWatcher
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			copyPrefixed(os.Stdout, io.TeeReader(stdout, &forward), kspace, kOpts.grep)
+		}()
+		go func() {
+			defer wg.Done()
+			copyPrefixed(os.Stderr, stderr, kspace, nil)
+		}()
+
+		if err := startChild(kCmd); err != nil {
+			if rootCtx.Err() == nil {
+				logger.Error(err.Error(), "kspace", kspace)
+			}
+			return 1
+		}
+		wg.Wait()
+		err = waitChild(kCmd)
+		if rootCtx.Err() != nil {
+			// k was interrupted, don't reconnect
+			return 0
+		}
+
+		// a forward that was up for a while gets a fresh backoff
+		if time.Since(started) > 30*time.Second {
+			backoff = time.Second
+		}
+		status := "exited"
+		if err != nil {
+			status = err.Error()
+		}
+		if forward.up.Load() {
+			everUp, failures = true, 0
+		} else {
+			failures++
+		}
+		if !everUp || failures >= maxPortForwardFailures {
+			logger.Error(fmt.Sprintf("port-forward %s, giving up", status), "kspace", kspace)
+			if exitError, ok := err.(*exec.ExitError); ok && exitError.ExitCode() != 0 {
+				return exitError.ExitCode()
+			}
+			return 1
+		}
+		logger.Warn(fmt.Sprintf("port-forward %s, reconnecting in %s", status, backoff), "kspace", kspace)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
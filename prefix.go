@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	goocolor "github.com/gookit/color"
+)
+
+// prefixPalette is the set of colors used to tell targets apart when the
+// output of several kubectl processes is multiplexed together
+var prefixPalette = []goocolor.Color{
+	goocolor.FgCyan,
+	goocolor.FgGreen,
+	goocolor.FgYellow,
+	goocolor.FgMagenta,
+	goocolor.FgBlue,
+	goocolor.FgLightRed,
+	goocolor.FgLightCyan,
+	goocolor.FgLightGreen,
+	goocolor.FgLightYellow,
+	goocolor.FgLightMagenta,
+	goocolor.FgLightBlue,
+	goocolor.FgRed,
+}
+
+var (
+	// prefixWidth is the length of the longest kspace so prefixes line up
+	prefixWidth int
+	// prefixColors maps each kspace to its color for this run
+	prefixColors = map[string]goocolor.Color{}
+	// outputMu keeps lines from different targets from being interleaved
+	outputMu sync.Mutex
+)
+
+// setupPrefixes assigns every kspace a color and calculates the prefix
+// width. Colors are assigned in sorted order so the same targets always get
+// the same colors, and they stay distinct until the palette runs out.
+func setupPrefixes(names []string) {
+	for i, name := range sortedCopy(names) {
+		if len(name) > prefixWidth {
+			prefixWidth = len(name)
+		}
+		prefixColors[name] = prefixPalette[i%len(prefixPalette)]
+	}
+}
+
+// formatPrefix returns the label printed in front of every line from kspace
+func formatPrefix(kspace string) string {
+	var parts []string
+	if kOpts.timestamps {
+		parts = append(parts, time.Now().Format("15:04:05.000"))
+	}
+	if kspace != "" {
+		label := fmt.Sprintf("%-*s", prefixWidth, kspace)
+		if c, ok := prefixColors[kspace]; ok && colorEnabled {
+			label = c.Sprint(label)
+		}
+		parts = append(parts, label)
+	}
+	return strings.Join(parts, " ")
+}
+
+// writePrefixedLine writes line to w with the kspace prefix
+func writePrefixedLine(w io.Writer, kspace string, line string) {
+	if !strings.HasSuffix(line, "\n") {
+		line += "\n"
+	}
+
+	prefix := formatPrefix(kspace)
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	if prefix == "" {
+		fmt.Fprint(w, line)
+		return
+	}
+	fmt.Fprintf(w, "%s  %s", prefix, line)
+}
+
+// copyPrefixed copies r to w line by line adding the kspace prefix. Lines
+// are read without a length limit so long JSON lines aren't truncated. Lines
+// not matching grep are dropped, it's only set for kubectl's stdout so
+// errors are never hidden.
+func copyPrefixed(w io.Writer, r io.Reader, kspace string, grep *regexp.Regexp) {
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" && (grep == nil || grep.MatchString(line)) {
+			writePrefixedLine(w, kspace, line)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// defaultProbeTimeout is how long a target's API server has to answer
+// /readyz before it's reported unreachable
+const defaultProbeTimeout = 5 * time.Second
+
+// probeResult is the outcome of checking one target's API server
+type probeResult struct {
+	latency time.Duration
+	version string
+	err     error
+}
+
+// probeTarget checks that the API server of a target answers /readyz
+// within timeout using the target's own kubectl and credentials. When
+// withVersion is true the server version is read too.
+func probeTarget(r Runner, target Target, env envDefaults, timeout time.Duration, withVersion bool) probeResult {
+	// only the context matters, --all-namespaces can't be used with --raw
+	target = Target{context: target.context}
+	targetEnv := envDefaults{context: env.context}
+
+	started := time.Now()
+	if _, err := rawRequest(r, buildKubectlArgs([]string{"get", "--raw", "/readyz"}, target, targetEnv), timeout); err != nil {
+		return probeResult{latency: time.Since(started), err: err}
+	}
+	result := probeResult{latency: time.Since(started)}
+
+	if withVersion {
+		// the server answered, so a missing version doesn't make it unreachable
+		result.version = "unknown"
+		out, err := rawRequest(r, buildKubectlArgs([]string{"get", "--raw", "/version"}, target, targetEnv), timeout)
+		var v struct {
+			GitVersion string `json:"gitVersion"`
+		}
+		if err == nil && json.Unmarshal(out, &v) == nil && v.GitVersion != "" {
+			result.version = v.GitVersion
+		}
+	}
+	return result
+}
+
+// rawRequest runs kubectl with args and returns its output. kubectl is
+// killed if it hasn't finished shortly after timeout, since its own
+// --request-timeout doesn't cover every step (e.g. credential plugins).
+func rawRequest(r Runner, args []string, timeout time.Duration) ([]byte, error) {
+	args = append(args, "--request-timeout", timeout.String())
+	var stdout, stderr bytes.Buffer
+	kCmd := r.Command(args)
+	kCmd.Stdout = &stdout
+	kCmd.Stderr = &stderr
+	if err := startChild(kCmd); err != nil {
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- waitChild(kCmd) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, errors.New(lastLine(stderr.String(), err.Error()))
+		}
+		return stdout.Bytes(), nil
+	case <-time.After(timeout + time.Second):
+		kCmd.Process.Kill()
+		return nil, fmt.Errorf("no answer within %s", timeout)
+	}
+}
+
+// lastLine returns the last non-empty line of s or fallback
+func lastLine(s string, fallback string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	if line := strings.TrimSpace(lines[len(lines)-1]); line != "" {
+		return line
+	}
+	return fallback
+}
+
+// probeTargets checks every target in parallel. Targets using the same
+// context (e.g. several namespaces) share one check.
+func probeTargets(targets map[string]Target, runners map[string]Runner, env envDefaults, timeout time.Duration, withVersion bool) map[string]probeResult {
+	byContext := make(map[string][]string)
+	for _, name := range sortedCopy(mapKeys(targets)) {
+		context := targetContext(nil, targets[name], env)
+		byContext[context] = append(byContext[context], name)
+	}
+
+	results := make(map[string]probeResult)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, names := range byContext {
+		wg.Add(1)
+		go func(names []string) {
+			defer wg.Done()
+			result := probeTarget(runners[names[0]], targets[names[0]], env, timeout, withVersion)
+			mu.Lock()
+			defer mu.Unlock()
+			for _, name := range names {
+				results[name] = result
+			}
+		}(names)
+	}
+	wg.Wait()
+	return results
+}
+
+// printPing prints a line per target with its latency and server version
+// and returns false if any target is unreachable
+func printPing(w io.Writer, names []string, results map[string]probeResult) bool {
+	ok := true
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TARGET\tSTATUS\tLATENCY\tVERSION")
+	for _, name := range names {
+		r := results[name]
+		latency := r.latency.Round(time.Millisecond)
+		if r.err != nil {
+			ok = false
+			fmt.Fprintf(tw, "%s\tunreachable\t%s\t%s\n", name, latency, r.err)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\tok\t%s\t%s\n", name, latency, r.version)
+	}
+	tw.Flush()
+	return ok
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	// shutdownGrace is how long kubectl processes get to exit after k
+	// passes them a signal before they're killed
+	shutdownGrace = 5 * time.Second
+
+	// rootCtx is done once k is interrupted. Every kubectl is started
+	// with it so the signal reaches all of them.
+	rootCtx, cancelRoot = context.WithCancel(context.Background())
+
+	// children are the kubectl processes that are running
+	children   = make(map[*exec.Cmd]bool)
+	childrenMu sync.Mutex
+
+	// interruptedBy is the signal that stopped k, or nil
+	interruptedBy   os.Signal
+	interruptedByMu sync.Mutex
+)
+
+// withShutdown makes cmd get the signal k was interrupted by and be killed
+// if it's still running after the grace period
+func withShutdown(cmd *exec.Cmd) *exec.Cmd {
+	cmd.Cancel = func() error {
+		sig := interruptSignal()
+		if sig == nil {
+			sig = os.Interrupt
+		}
+		if err := cmd.Process.Signal(sig); err != nil {
+			// not every platform can send signals
+			return cmd.Process.Kill()
+		}
+		return nil
+	}
+	cmd.WaitDelay = shutdownGrace
+	return cmd
+}
+
+// startChild starts cmd and tracks it until waitChild
+func startChild(cmd *exec.Cmd) error {
+	childrenMu.Lock()
+	defer childrenMu.Unlock()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	children[cmd] = true
+	return nil
+}
+
+// waitChild waits for a command started by startChild
+func waitChild(cmd *exec.Cmd) error {
+	err := cmd.Wait()
+	childrenMu.Lock()
+	defer childrenMu.Unlock()
+	delete(children, cmd)
+	return err
+}
+
+// signalChildren sends sig to every running kubectl
+func signalChildren(sig os.Signal) {
+	childrenMu.Lock()
+	defer childrenMu.Unlock()
+	for cmd := range children {
+		cmd.Process.Signal(sig)
+	}
+}
+
+// interruptSignal returns the signal that stopped k, or nil
+func interruptSignal() os.Signal {
+	interruptedByMu.Lock()
+	defer interruptedByMu.Unlock()
+	return interruptedBy
+}
+
+// interrupt stops k because of sig. Every kubectl gets sig and anything
+// that was about to start won't.
+func interrupt(sig os.Signal) {
+	interruptedByMu.Lock()
+	if interruptedBy == nil {
+		interruptedBy = sig
+	}
+	interruptedByMu.Unlock()
+	cancelRoot()
+}
+
+// signalExitCode returns the conventional exit code for being stopped by
+// sig, 128 plus the signal number (130 for SIGINT)
+func signalExitCode(sig os.Signal) int {
+	if s, ok := sig.(syscall.Signal); ok {
+		return 128 + int(s)
+	}
+	return 130
+}
+
+// handleSignals passes signals on to kubectl. The first SIGINT, SIGTERM or
+// SIGHUP is passed to every kubectl, and k exits once they have exited or
+// after the grace period. Another one kills them straight away.
+func handleSignals() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, append(shutdownSignals, resizeSignals...)...)
+	go func() {
+		for sig := range ch {
+			if isResizeSignal(sig) {
+				signalChildren(sig)
+				continue
+			}
+			if interruptSignal() != nil {
+				signalChildren(os.Kill)
+				exit(signalExitCode(interruptSignal()))
+			}
+			interrupt(sig)
+			// k exits by itself once every kubectl is done, this is in
+			// case something doesn't let go
+			go func() {
+				time.Sleep(shutdownGrace + time.Second)
+				signalChildren(os.Kill)
+				exit(signalExitCode(sig))
+			}()
+		}
+	}()
+}
+
+// isResizeSignal checks if sig means the terminal was resized
+func isResizeSignal(sig os.Signal) bool {
+	for _, s := range resizeSignals {
+		if s == sig {
+			return true
+		}
+	}
+	return false
+}
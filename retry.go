@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// timeoutExitCode is the exit code of a target killed by --k-timeout,
+	// the same as timeout(1)
+	timeoutExitCode = 124
+	// maxRetryBackoff caps the wait between retries
+	maxRetryBackoff = 10 * time.Second
+)
+
+// idempotentVerbs are kubectl commands that only read, so running them
+// again after a failure is safe
+var idempotentVerbs = []string{"get", "describe", "top", "api-resources", "api-versions", "explain", "version", "cluster-info"}
+
+// isRetryable checks if a failed command can be run again
+func isRetryable(args []string) bool {
+	if isStreamingCommand(args) {
+		return false
+	}
+	_, ok := sliceFind(idempotentVerbs, parseKubectlArgs(args).verb)
+	return ok
+}
+
+// retryBackoff returns how long to wait before retry attempt (from 1)
+func retryBackoff(attempt int) time.Duration {
+	backoff := 500 * time.Millisecond
+	for i := 1; i < attempt && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxRetryBackoff)
+}
+
+// retryKubectl calls run until it returns 0, up to --k-retries more times
+// for commands that only read, and returns the last exit code
+func retryKubectl(args []string, kspace string, run func() int) int {
+	code := run()
+	if !isRetryable(args) {
+		return code
+	}
+	for attempt := 1; code != 0 && attempt <= kOpts.retries; attempt++ {
+		wait := retryBackoff(attempt)
+		if kOpts.collect == "" {
+			logger.Warn(fmt.Sprintf("exit code %d, retrying in %s (%d/%d)", code, wait, attempt, kOpts.retries), "kspace", kspace)
+		}
+		time.Sleep(wait)
+		code = run()
+	}
+	return code
+}
+
+// killTimer kills a command when it runs too long
+type killTimer struct {
+	timer  *time.Timer
+	killed atomic.Bool
+}
+
+// killAfter kills kCmd if it's still running after timeout. A timeout of 0
+// never kills it.
+func killAfter(kCmd *exec.Cmd, timeout time.Duration) *killTimer {
+	t := &killTimer{}
+	if timeout > 0 {
+		t.timer = time.AfterFunc(timeout, func() {
+			t.killed.Store(true)
+			kCmd.Process.Kill()
+		})
+	}
+	return t
+}
+
+// stop stops the timer and reports if the command was killed
+func (t *killTimer) stop() bool {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	return t.killed.Load()
+}
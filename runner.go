@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// Runner creates the commands that run kubectl. Everything k runs goes
+// through one, so tests can swap in a fake kubectl.
+type Runner interface {
+	// Command returns a command running kubectl with args
+	Command(args []string) *exec.Cmd
+}
+
+// kubectlRunner runs a kubectl binary (or kubectl plugin) with the merged
+// KUBECONFIG and the environment variables the k config adds for a context
+type kubectlRunner struct {
+	binary     string
+	kubeconfig string
+	env        []string
+}
+
+// defaultRunner runs the commands that aren't for one target, like reading
+// kubeconfig or listing namespaces. main points it at the kubectl found on
+// PATH and the KUBECONFIG it builds.
+var defaultRunner Runner = kubectlRunner{binary: "kubectl"}
+
+// Command creates a Cmd that is stopped along with k
+func (r kubectlRunner) Command(args []string) *exec.Cmd {
+	kCmd := withShutdown(exec.CommandContext(rootCtx, r.binary, args...))
+	// set Env to get Env from parent
+	kCmd.Env = append(os.Environ(),
+		"KUBECONFIG="+r.kubeconfig,
+	)
+	kCmd.Env = append(kCmd.Env, r.env...)
+	return kCmd
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// shutdownSignals stop k and are passed on to kubectl
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGHUP}
+
+// resizeSignals are passed on to kubectl without stopping k
+var resizeSignals = []os.Signal{syscall.SIGWINCH}
+
+// detach starts cmd in its own process group so Ctrl-C in the terminal
+// doesn't reach it, e.g. a tunnel kept running after k exits
+func detach(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// shutdownSignals stop k and are passed on to kubectl
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// resizeSignals are passed on to kubectl without stopping k. Windows has
+// no resize signal.
+var resizeSignals []os.Signal
+
+// detach starts cmd in its own process group so Ctrl-C in the console
+// doesn't reach it, e.g. a tunnel kept running after k exits
+func detach(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
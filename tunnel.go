@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// tunnelStartTimeout is how long a tunnel command has to start listening
+	tunnelStartTimeout = 10 * time.Second
+	// tunnelSupervisorCommand is the hidden command that runs a kept tunnel
+	// and stops it once it's unused, whether or not k is run again
+	tunnelSupervisorCommand = "__tunnel"
+)
+
+/*
+tunnelConfig is how a context is reached when it's behind a bastion. Either
+Proxy is used as is or Command is started to open a SOCKS5 proxy, e.g.
+
+	tunnel:
+	  command: [ssh, -N, -D, "{port}", bastion.example.com]
+	  idle: 10m
+
+{port} is replaced with a free local port. The proxy is passed to kubectl as
+HTTPS_PROXY.
+*/
+type tunnelConfig struct {
+	// Proxy is an http://, https:// or socks5:// proxy URL
+	Proxy string `yaml:"proxy"`
+	// Command starts a SOCKS5 proxy listening on {port}
+	Command []string `yaml:"command"`
+	// Idle keeps the tunnel running after k exits so later runs can use
+	// it. It stops itself once it's been unused this long.
+	Idle time.Duration `yaml:"idle"`
+}
+
+// tunnelState is a tunnel kept running between k runs. Pid is its
+// supervisor's.
+type tunnelState struct {
+	Pid      int       `json:"pid"`
+	Port     int       `json:"port"`
+	LastUsed time.Time `json:"lastUsed"`
+}
+
+var (
+	// openTunnels maps tunnel commands to their proxy URL for this run so
+	// targets behind the same bastion share a tunnel
+	openTunnels   = make(map[string]string)
+	openTunnelsMu sync.Mutex
+)
+
+// tunnelStatePath returns where tunnels kept between runs are recorded
+func tunnelStatePath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "k", "tunnels.json")
+}
+
+func readTunnelState() map[string]tunnelState {
+	state := make(map[string]tunnelState)
+	p := tunnelStatePath()
+	if p == "" {
+		return state
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return state
+	}
+	json.Unmarshal(data, &state)
+	return state
+}
+
+func writeTunnelState(state map[string]tunnelState) {
+	p := tunnelStatePath()
+	if p == "" {
+		return
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+		return
+	}
+	os.WriteFile(p, data, 0o600)
+}
+
+// openTunnel returns the proxy URL for a tunnel, starting the tunnel
+// command if it isn't already running
+func openTunnel(t tunnelConfig) (string, error) {
+	if t.Proxy != "" {
+		return t.Proxy, nil
+	}
+	if len(t.Command) == 0 {
+		return "", errors.New("tunnel needs a proxy or a command")
+	}
+
+	key := strings.Join(t.Command, " ")
+	openTunnelsMu.Lock()
+	defer openTunnelsMu.Unlock()
+	if proxy, ok := openTunnels[key]; ok {
+		return proxy, nil
+	}
+
+	state := readTunnelState()
+	if s, ok := state[key]; ok && tunnelListening(s.Port) {
+		// a tunnel from an earlier run is still up
+		s.LastUsed = time.Now()
+		state[key] = s
+		writeTunnelState(state)
+		proxy := socksProxy(s.Port)
+		openTunnels[key] = proxy
+		useTunnel(key, t.Idle)
+		return proxy, nil
+	}
+
+	port, err := freeLocalPort()
+	if err != nil {
+		return "", err
+	}
+	cmd, err := startTunnel(key, t.Command, port, t.Idle)
+	if err != nil {
+		return "", err
+	}
+
+	if t.Idle > 0 {
+		state = readTunnelState()
+		state[key] = tunnelState{Pid: cmd.Process.Pid, Port: port, LastUsed: time.Now()}
+		writeTunnelState(state)
+		cmd.Process.Release()
+		useTunnel(key, t.Idle)
+	} else {
+		atExit(func() { cmd.Process.Kill() })
+	}
+
+	proxy := socksProxy(port)
+	openTunnels[key] = proxy
+	return proxy, nil
+}
+
+// startTunnel runs a tunnel command and waits until it listens on port. A
+// tunnel kept while idle is run by k's tunnel supervisor and detached from
+// k so interrupting k doesn't stop it.
+func startTunnel(key string, command []string, port int, idle time.Duration) (*exec.Cmd, error) {
+	args := make([]string, len(command))
+	for i, arg := range command {
+		args[i] = strings.ReplaceAll(arg, "{port}", strconv.Itoa(port))
+	}
+	name := args[0]
+	if idle > 0 {
+		self, err := os.Executable()
+		if err != nil {
+			return nil, err
+		}
+		args = append([]string{self, tunnelSupervisorCommand, idle.String(), key, "--"}, args...)
+	}
+
+	// the tunnel may outlive k, so its errors go to a file instead of a pipe
+	logFile, err := os.CreateTemp("", "k-tunnel-*.log")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(logFile.Name())
+	defer logFile.Close()
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if idle > 0 {
+		detach(cmd)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting tunnel %s: %w", name, err)
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		cmd.Process.Wait()
+		close(exited)
+	}()
+
+	deadline := time.Now().Add(tunnelStartTimeout)
+	for !tunnelListening(port) {
+		select {
+		case <-exited:
+			output, _ := os.ReadFile(logFile.Name())
+			return nil, fmt.Errorf("tunnel %s exited: %s", name, strings.TrimSpace(string(output)))
+		case <-time.After(50 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			// the supervisor stops its tunnel when interrupted
+			if err := cmd.Process.Signal(os.Interrupt); err != nil {
+				cmd.Process.Kill()
+			}
+			return nil, fmt.Errorf("tunnel %s didn't listen on port %d within %s", name, port, tunnelStartTimeout)
+		}
+	}
+	return cmd, nil
+}
+
+// runTunnelSupervisor runs a tunnel kept while idle. args are the idle
+// timeout, the tunnel's key in the tunnel state, "--" and the tunnel
+// command. The tunnel is stopped once no k run has used it for the idle
+// timeout and is forgotten when it exits.
+func runTunnelSupervisor(args []string) int {
+	if len(args) < 4 || args[2] != "--" {
+		fmt.Fprintf(os.Stderr, "usage: k %s <idle> <key> -- <command> [args...]\n", tunnelSupervisorCommand)
+		return 1
+	}
+	idle, err := time.ParseDuration(args[0])
+	if err != nil || idle <= 0 {
+		fmt.Fprintf(os.Stderr, "k %s: invalid idle timeout %q\n", tunnelSupervisorCommand, args[0])
+		return 1
+	}
+	key, command := args[1], args[3:]
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer forgetTunnel(key, os.Getpid())
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, shutdownSignals...)
+	started := time.Now()
+	ticker := time.NewTicker(min(max(idle/10, 10*time.Millisecond), time.Minute))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-exited:
+			return 0
+		case <-signals:
+			cmd.Process.Kill()
+		case <-ticker.C:
+			if time.Since(tunnelLastUsed(key, started)) >= idle {
+				cmd.Process.Kill()
+			}
+		}
+	}
+}
+
+// tunnelLastUsed returns when the tunnel run by this supervisor was last
+// used, or since when it's been running if it hasn't been recorded yet
+func tunnelLastUsed(key string, started time.Time) time.Time {
+	s, ok := readTunnelState()[key]
+	if ok && s.Pid == os.Getpid() && s.LastUsed.After(started) {
+		return s.LastUsed
+	}
+	return started
+}
+
+// forgetTunnel removes a tunnel from the tunnel state unless it has already
+// been replaced by another supervisor
+func forgetTunnel(key string, pid int) {
+	state := readTunnelState()
+	if s, ok := state[key]; ok && s.Pid == pid {
+		delete(state, key)
+		writeTunnelState(state)
+	}
+}
+
+// useTunnel marks a kept tunnel as used until k exits, so it isn't stopped
+// while a long running command like logs -f is using it
+func useTunnel(key string, idle time.Duration) {
+	done := make(chan struct{})
+	atExit(func() {
+		close(done)
+		touchTunnel(key)
+	})
+	if idle <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(idle / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				touchTunnel(key)
+			}
+		}
+	}()
+}
+
+// touchTunnel marks a kept tunnel as used now
+func touchTunnel(key string) {
+	state := readTunnelState()
+	if s, ok := state[key]; ok {
+		s.LastUsed = time.Now()
+		state[key] = s
+		writeTunnelState(state)
+	}
+}
+
+// tunnelListening checks if something accepts connections on a local port
+func tunnelListening(port int) bool {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), 200*time.Millisecond)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// freeLocalPort asks the OS for an unused local port
+func freeLocalPort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+func socksProxy(port int) string {
+	return "socks5://127.0.0.1:" + strconv.Itoa(port)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+// watchAgg merges `get --watch` output from multiple targets when set
+var watchAgg *watchAggregator
+
+// kubectl separates table columns with at least three spaces while values
+// like "1 (2d ago)" only contain single spaces
+var watchColumnSep = regexp.MustCompile(`\s{2,}`)
+
+// watchAggregator keeps a merged table of the objects watched across all
+// targets. When live is true the whole table is redrawn in place on every
+// event, otherwise every event is printed as a line with its kspace.
+type watchAggregator struct {
+	mu sync.Mutex
+	w  io.Writer
+
+	live          bool
+	cleared       bool
+	header        []string
+	headerPrinted bool
+	rows          map[string]watchRow
+}
+
+type watchRow struct {
+	kspace  string
+	columns []string
+}
+
+func newWatchAggregator(w io.Writer, live bool) *watchAggregator {
+	return &watchAggregator{
+		w:    w,
+		live: live,
+		rows: make(map[string]watchRow),
+	}
+}
+
+// isWatchCommand checks if args are a `get` watch with table output that
+// can be merged. Custom output formats are left alone.
+func isWatchCommand(args []string) bool {
+	parsed := parseKubectlArgs(args)
+	if parsed.verb != "get" || !isStreamingCommand(args) {
+		return false
+	}
+	output, found := parsed.value("output")
+	return !found || output == "wide"
+}
+
+// watchArgs adds --output-watch-events so every row starts with its event type
+func watchArgs(args []string) []string {
+	if parseKubectlArgs(args).has("output-watch-events") {
+		return args
+	}
+	return append(args, "--output-watch-events")
+}
+
+// copy reads watch output for kspace from r until it is closed
+func (a *watchAggregator) copy(r io.Reader, kspace string) {
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			a.handleLine(kspace, line)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// handleLine processes a single line of `get --watch --output-watch-events`
+// output from kspace
+func (a *watchAggregator) handleLine(kspace string, line string) {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	columns := watchColumnSep.Split(strings.TrimSpace(line), -1)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if columns[0] == "EVENT" {
+		if a.header == nil {
+			a.header = columns[1:]
+		}
+		return
+	}
+	if len(columns) < 2 {
+		return
+	}
+
+	event, columns := columns[0], columns[1:]
+	key := kspace + "/" + strings.Join(a.keyColumns(columns), "/")
+	if event == "DELETED" {
+		delete(a.rows, key)
+	} else {
+		a.rows[key] = watchRow{kspace: kspace, columns: columns}
+	}
+
+	if a.live {
+		a.render()
+		return
+	}
+
+	if !a.headerPrinted && a.header != nil {
+		fmt.Fprintf(a.w, "%-8s %-*s  %s\n", "EVENT", prefixWidth, "KSPACE", strings.Join(a.header, "   "))
+		a.headerPrinted = true
+	}
+	fmt.Fprintf(a.w, "%-8s %s  %s\n", event, formatPrefix(kspace), strings.Join(columns, "   "))
+}
+
+// keyColumns returns the columns identifying an object, which are NAME and
+// NAMESPACE when the table has one
+func (a *watchAggregator) keyColumns(columns []string) []string {
+	var key []string
+	for i, name := range a.header {
+		if (name == "NAMESPACE" || name == "NAME") && i < len(columns) {
+			key = append(key, columns[i])
+		}
+	}
+	if len(key) == 0 {
+		key = append(key, columns[0])
+	}
+	return key
+}
+
+// render redraws the merged table from the top of the terminal
+func (a *watchAggregator) render() {
+	keys := make([]string, 0, len(a.rows))
+	for key := range a.rows {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	if !a.cleared {
+		fmt.Fprint(a.w, "\033[2J")
+		a.cleared = true
+	}
+
+	// move the cursor home and clear everything after the table so the
+	// screen doesn't flicker on every update
+	fmt.Fprint(a.w, "\033[H")
+	tw := tabwriter.NewWriter(a.w, 0, 8, 3, ' ', 0)
+	fmt.Fprintf(tw, "KSPACE\t%s\033[K\n", strings.Join(a.header, "\t"))
+	for _, key := range keys {
+		row := a.rows[key]
+		fmt.Fprintf(tw, "%s\t%s\033[K\n", row.kspace, strings.Join(row.columns, "\t"))
+	}
+	tw.Flush()
+	fmt.Fprint(a.w, "\033[J")
+}